@@ -2,7 +2,10 @@ package cli
 
 import (
 	"d7024e/server"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -12,14 +15,66 @@ func init() {
 }
 
 var getCmd = &cobra.Command{
-	Use:   "get",
-	Short: "Get a value",
-	Long:  "Get a value",
+	Use:   "get <key>...",
+	Short: "Get values",
+	Long:  "Get the values stored under one or more keys and the nodes they were retrieved from",
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		conn := server.ConnectToServer(server.DEFAULT_SOCKET)
 		defer conn.Close()
-		server.SendMessage(conn, "get"+server.SEPARATING_STRING+args[0])
+
+		if len(args) == 1 {
+			server.SendMessage(conn, "get"+server.SEPARATING_STRING+args[0])
+			response := server.ListenToResponse(conn)
+
+			var reply server.GetReply
+			if err := json.Unmarshal([]byte(response), &reply); err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid response from the node:", err)
+				os.Exit(1)
+			}
+			reply.Key = args[0]
+			if !printGetReply(reply, false) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		server.SendMessage(conn, "mget"+server.SEPARATING_STRING+strings.Join(args, server.KEYS_SEPARATOR))
 		response := server.ListenToResponse(conn)
-		fmt.Println(response)
+
+		var replies []server.GetReply
+		if err := json.Unmarshal([]byte(response), &replies); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid response from the node:", err)
+			os.Exit(1)
+		}
+		failed := false
+		for _, reply := range replies {
+			if !printGetReply(reply, true) {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
+
+// printGetReply prints the value and where it came from, prefixed by the key when
+// several keys were asked for. It returns false if the value was not found
+func printGetReply(reply server.GetReply, withKey bool) bool {
+	if reply.Error != "" {
+		fmt.Fprintln(os.Stderr, "Could not get", reply.Key+":", reply.Error)
+		return false
+	}
+	if withKey {
+		fmt.Printf("%s: %s\n", reply.Key, reply.Value)
+	} else {
+		fmt.Println(reply.Value)
+	}
+	if reply.Local {
+		fmt.Printf("Retrieved from the local store of node %s at %s\n", reply.SourceID, reply.SourceAddress)
+	} else {
+		fmt.Printf("Retrieved from node %s at %s after %d hops\n", reply.SourceID, reply.SourceAddress, reply.Hops)
+	}
+	return true
+}
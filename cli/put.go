@@ -1,8 +1,12 @@
 package cli
 
 import (
+	"d7024e/kademlia"
 	"d7024e/server"
+	"encoding/json"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -20,6 +24,22 @@ var putCmd = &cobra.Command{
 		defer conn.Close()
 		server.SendMessage(conn, "put"+server.SEPARATING_STRING+args[0])
 		response := server.ListenToResponse(conn)
-		fmt.Println("Value stored at key", response)
+
+		var result kademlia.StoreResult
+		if err := json.Unmarshal([]byte(response), &result); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid response from the node:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Value stored at key", result.Key)
+		fmt.Printf("Replicated on %d of %d nodes\n", result.Acknowledged(), result.Wanted)
+		if Verbose {
+			for _, replica := range result.Replicas {
+				status := "stored"
+				if !replica.Stored {
+					status = "failed: " + replica.Err
+				}
+				fmt.Printf("  %s %s %v %s\n", replica.ID, replica.Address, replica.Latency.Round(time.Millisecond), status)
+			}
+		}
 	},
 }
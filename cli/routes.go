@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"bytes"
+	"d7024e/kademlia"
+	"d7024e/server"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var routesJSON bool
+
+func init() {
+	routesCmd.Flags().BoolVar(&routesJSON, "json", false, "print the routing table as JSON")
+	rootCmd.AddCommand(routesCmd)
+}
+
+var routesCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "Show the routing table",
+	Long:  "Show the buckets of the routing table of the node with their contacts and when they were last seen",
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := server.ConnectToServer(server.DEFAULT_SOCKET)
+		defer conn.Close()
+		server.SendMessage(conn, "routes")
+		response := server.ListenToResponse(conn)
+
+		if routesJSON {
+			printJSON(response)
+			return
+		}
+
+		var snapshot kademlia.RoutingTableSnapshot
+		if err := json.Unmarshal([]byte(response), &snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid response from the node: %v\n%s\n", err, response)
+			os.Exit(1)
+		}
+		printRoutes(snapshot)
+	},
+}
+
+// printJSON prints the JSON reply of the node indented, or as it is if it is not JSON
+func printJSON(response string) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(response), "", "  "); err != nil {
+		fmt.Println(response)
+		return
+	}
+	fmt.Println(indented.String())
+}
+
+// printRoutes prints one line per bucket followed by one line per contact
+func printRoutes(snapshot kademlia.RoutingTableSnapshot) {
+	fmt.Printf("Node %s at %s, %d contacts in %d buckets\n",
+		snapshot.ID, snapshot.Address, snapshot.Stats.Contacts, snapshot.Stats.Buckets)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tPREFIX\tFILL\tREPLACEMENTS\tLAST ACTIVITY")
+	for _, bucket := range snapshot.Buckets {
+		prefix := bucket.Prefix
+		if prefix == "" {
+			prefix = "*"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d/%d\t%d\t%s\n", bucket.Index, prefix, len(bucket.Contacts), bucket.Size,
+			bucket.Replacements, bucket.LastActivity.Local().Format(TimeLayout))
+		for _, contact := range bucket.Contacts {
+			fmt.Fprintf(w, "  %s\t%s\tfailures %d\t\t%s\n", contact.ID, contact.Address,
+				contact.Failures, contact.LastSeen.Local().Format(TimeLayout))
+		}
+	}
+	w.Flush()
+
+	stats := snapshot.Stats
+	rejected := stats.RejectedIPInBucket + stats.RejectedSubnetInBucket + stats.RejectedIPInTable + stats.RejectedSubnetInTable
+	if rejected > 0 || Verbose {
+		fmt.Printf("Rejected contacts: %d same IP in bucket, %d same subnet in bucket, %d same IP in table, %d same subnet in table\n",
+			stats.RejectedIPInBucket, stats.RejectedSubnetInBucket, stats.RejectedIPInTable, stats.RejectedSubnetInTable)
+	}
+}
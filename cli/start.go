@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"d7024e/kademlia"
+	"d7024e/server"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	startConfig    = kademlia.DefaultConfig()
+	startBootstrap string
+	startPort      int
+)
+
+func init() {
+	startCmd.Flags().StringVar(&startBootstrap, "bootstrap", "", "address of a node of the network to join")
+	startCmd.Flags().IntVar(&startPort, "port", server.DEFAULT_PORT, "UDP port of the node")
+	startCmd.Flags().IntVarP(&startConfig.K, "k", "k", startConfig.K, "bucket size and replication factor")
+	startCmd.Flags().IntVar(&startConfig.Alpha, "alpha", startConfig.Alpha, "number of concurrent RPCs in a lookup")
+	startCmd.Flags().IntVarP(&startConfig.B, "b", "b", startConfig.B, "branching factor of the routing tree")
+	startCmd.Flags().DurationVar(&startConfig.RPCTimeout, "rpc-timeout", startConfig.RPCTimeout, "time to wait for the answer to an RPC")
+	startCmd.Flags().DurationVar(&startConfig.StaleTimeout, "stale-timeout", startConfig.StaleTimeout, "time after which a lookup stops waiting on a slow contact")
+	startCmd.Flags().DurationVar(&startConfig.TTL, "ttl", startConfig.TTL, "time a stored value lives without being requested")
+	startCmd.Flags().DurationVar(&startConfig.RefreshInterval, "refresh-interval", startConfig.RefreshInterval, "time after which an idle bucket is refreshed")
+	startCmd.Flags().IntVar(&startConfig.MaxFailures, "max-failures", startConfig.MaxFailures, "consecutive timeouts after which a contact is removed")
+	startCmd.Flags().StringVar(&startConfig.DataDir, "data-dir", "", "directory where the node ID and routing table are kept across restarts")
+	startCmd.Flags().BoolVar(&startConfig.VerifiableID, "verifiable-id", false, "use the hash of an ed25519 public key as node ID")
+	startCmd.Flags().BoolVar(&startConfig.RequireKeys, "require-keys", false, "drop messages from peers whose ID is not the hash of their public key")
+	startCmd.Flags().BoolVar(&startConfig.NoLocalCopy, "no-local-copy", false, "keep no copy of the values put by this node")
+	startCmd.Flags().StringVar(&startConfig.Codec, "codec", startConfig.Codec, "encoding of the messages sent, json or binary")
+	startCmd.Flags().BoolVar(&startConfig.Encrypt, "encrypt", false, "encrypt the messages sent to every peer and drop the ones received in the clear")
+	startCmd.Flags().IntVar(&startConfig.MaxPerIPInBucket, "max-per-ip-in-bucket", 0, "contacts sharing an IP address allowed in a bucket, 0 for no limit")
+	startCmd.Flags().IntVar(&startConfig.MaxPerSubnetInBucket, "max-per-subnet-in-bucket", 0, "contacts sharing a /24 (/64 for IPv6) subnet allowed in a bucket, 0 for no limit")
+	startCmd.Flags().IntVar(&startConfig.MaxPerIPInTable, "max-per-ip-in-table", 0, "contacts sharing an IP address allowed in the routing table, 0 for no limit")
+	startCmd.Flags().IntVar(&startConfig.MaxPerSubnetInTable, "max-per-subnet-in-table", 0, "contacts sharing a /24 (/64 for IPv6) subnet allowed in the routing table, 0 for no limit")
+	rootCmd.AddCommand(startCmd)
+}
+
+var startCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start a node",
+	Long:  "Start a node listening on the default socket",
+	Run: func(cmd *cobra.Command, args []string) {
+		serv := server.NewServerWithPort(server.DEFAULT_SOCKET, startBootstrap, startPort, startConfig)
+		serv.Listen()
+	},
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"d7024e/kademlia"
+	"d7024e/server"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var traceJSON bool
+
+func init() {
+	traceCmd.Flags().BoolVar(&traceJSON, "json", false, "print the trace as JSON")
+	rootCmd.AddCommand(traceCmd)
+}
+
+var traceCmd = &cobra.Command{
+	Use:   "trace <key>",
+	Short: "Trace the lookup of a value",
+	Long:  "Look up a value and show every contact queried, its round, round-trip time and answer, and how the closest distance to the key changed from round to round",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := server.ConnectToServer(server.DEFAULT_SOCKET)
+		defer conn.Close()
+		server.SendMessage(conn, "trace"+server.SEPARATING_STRING+args[0])
+		response := server.ListenToResponse(conn)
+
+		if traceJSON {
+			printJSON(response)
+			return
+		}
+
+		var trace kademlia.LookupTrace
+		if err := json.Unmarshal([]byte(response), &trace); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid response from the node: %v\n%s\n", err, response)
+			os.Exit(1)
+		}
+		printTrace(trace)
+	},
+}
+
+// printTrace prints one line per query followed by the closest distance of every round
+func printTrace(trace kademlia.LookupTrace) {
+	outcome := "value not found"
+	if trace.Found {
+		outcome = "value found"
+	}
+	if trace.LocalHit {
+		outcome = "value found in the local store"
+	}
+	if trace.Err != "" {
+		outcome = trace.Err
+	}
+	fmt.Printf("Lookup of %s: %s after %v, %d queries\n", trace.Target, outcome, trace.Duration.Round(time.Millisecond), len(trace.Queries))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUND\tCONTACT\tADDRESS\tRTT\tRETURNED\tSTATUS")
+	for _, query := range trace.Queries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%v\t%d\t%s\n", query.Round, query.ID, query.Address,
+			query.RTT.Round(time.Millisecond), len(query.Returned), queryStatus(query))
+		if Verbose {
+			for _, contact := range query.Returned {
+				fmt.Fprintf(w, "\t  %s\t%s\t\t\t\n", contact.ID, contact.Address)
+			}
+		}
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUND\tQUERIES\tCLOSEST DISTANCE")
+	for _, round := range trace.Rounds {
+		fmt.Fprintf(w, "%d\t%d\t%s\n", round.Round, round.Queries, round.Closest)
+	}
+	w.Flush()
+}
+
+// queryStatus describes how a query of the trace ended
+func queryStatus(query kademlia.TraceQuery) string {
+	status := "answered"
+	switch {
+	case query.Value:
+		status = "value"
+	case query.TimedOut:
+		status = "timed out"
+	case query.Err != "":
+		status = "failed: " + query.Err
+	case query.RTT == 0:
+		status = "no answer"
+	}
+	if query.Stale {
+		status += " (stale)"
+	}
+	return status
+}
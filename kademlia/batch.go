@@ -0,0 +1,171 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// maxBatchLookups bounds the lookups a batch runs at the same time
+const maxBatchLookups = 8
+
+// KeyValueResult is the outcome of the lookup of one key of a batch
+type KeyValueResult struct {
+	Key string
+	ValueResult
+	Err error
+}
+
+func (kademlia *Kademlia) LookupValues(keys []string) []KeyValueResult {
+	return kademlia.LookupValuesContext(kademlia.ctx, keys)
+}
+
+// LookupValuesContext looks up the values of many keys and returns their results in the
+// order of the keys. The keys are looked up in order, so that keys sharing a prefix are
+// looked up together, and every contact learned by a lookup of the batch is a starting
+// point for the following ones, next to the contacts of the routing table
+func (kademlia *Kademlia) LookupValuesContext(ctx context.Context, keys []string) []KeyValueResult {
+	results := make([]KeyValueResult, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return NewKademliaID(keys[order[a]]).Less(NewKademliaID(keys[order[b]]))
+	})
+
+	ctx = withContactPool(ctx, &contactPool{})
+	slots := make(chan struct{}, maxBatchLookups)
+	var wg sync.WaitGroup
+	for _, i := range order {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i].ValueResult, results[i].Err = kademlia.LookupValueContext(ctx, keys[i])
+			<-slots
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// valueCall is a value lookup shared by the callers asking for the same key at the same time
+type valueCall struct {
+	done    chan struct{}
+	result  ValueResult
+	err     error
+	waiters int // Callers still waiting, the lookup is abandoned when none is left
+	cancel  context.CancelFunc
+}
+
+// sharedLookupValue runs lookupValue, unless a lookup of the same key is already
+// in progress in which case it waits for its result. A caller whose context is
+// done stops waiting without affecting the others
+func (kademlia *Kademlia) sharedLookupValue(ctx context.Context, key string) (ValueResult, error) {
+	kademlia.callsMu.Lock()
+	if kademlia.calls == nil {
+		kademlia.calls = make(map[string]*valueCall)
+	}
+	call, ok := kademlia.calls[key]
+	if !ok {
+		// The lookup keeps the values of the context of the first caller but is only
+		// canceled once every caller left, or when the node is closed
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		stop := context.AfterFunc(kademlia.ctx, cancel)
+		call = &valueCall{done: make(chan struct{}), cancel: cancel}
+		kademlia.calls[key] = call
+		go func() {
+			call.result, call.err = kademlia.lookupValue(callCtx, key)
+			stop()
+			cancel()
+			kademlia.callsMu.Lock()
+			if kademlia.calls[key] == call {
+				delete(kademlia.calls, key)
+			}
+			kademlia.callsMu.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	kademlia.callsMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, call.err
+	case <-ctx.Done():
+		kademlia.callsMu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Later callers must not join the abandoned lookup
+			call.cancel()
+			if kademlia.calls[key] == call {
+				delete(kademlia.calls, key)
+			}
+		}
+		kademlia.callsMu.Unlock()
+		return ValueResult{}, ctx.Err()
+	}
+}
+
+// contactPool collects the contacts learned by the lookups of a batch,
+// a nil pool learns nothing
+type contactPool struct {
+	mu       sync.Mutex
+	contacts map[KademliaID]Contact
+}
+
+type contactPoolKey struct{}
+
+// withContactPool returns a context that makes the lookups using it share the pool
+func withContactPool(ctx context.Context, pool *contactPool) context.Context {
+	return context.WithValue(ctx, contactPoolKey{}, pool)
+}
+
+// contactPoolFromContext returns the pool of the lookups of the context, or nil
+func contactPoolFromContext(ctx context.Context) *contactPool {
+	pool, _ := ctx.Value(contactPoolKey{}).(*contactPool)
+	return pool
+}
+
+// learn adds the contacts to the pool
+func (pool *contactPool) learn(contacts ...Contact) {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.contacts == nil {
+		pool.contacts = make(map[KademliaID]Contact)
+	}
+	for _, contact := range contacts {
+		pool.contacts[*contact.ID] = NewContact(contact.ID, contact.Address)
+	}
+}
+
+// forget removes the contact from the pool
+func (pool *contactPool) forget(id *KademliaID) {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	delete(pool.contacts, *id)
+}
+
+// closest returns at most count contacts of the pool, the closest to the target first
+func (pool *contactPool) closest(target *KademliaID, count int) []Contact {
+	if pool == nil {
+		return nil
+	}
+	pool.mu.Lock()
+	candidates := &ContactCandidates{}
+	for _, contact := range pool.contacts {
+		contact.CalcDistance(target)
+		candidates.Append([]Contact{contact})
+	}
+	pool.mu.Unlock()
+	candidates.Sort()
+	return candidates.GetContacts(min(candidates.Len(), count))
+}
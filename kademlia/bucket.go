@@ -2,41 +2,179 @@ package kademlia
 
 import (
 	"container/list"
-	"math/rand"
+	"time"
 )
 
 // bucket definition
-// contains a List
+// contains a List of contacts, most recently seen at the front,
+// and a replacement cache of recently seen contacts that did not fit.
+// The bucket covers every ID whose first depth bits equal those of prefix
+// and remembers when each contact, and any activity in its range, was last seen
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List
+	lastSeen     map[KademliaID]time.Time
+	pinging      *KademliaID // Least-recently seen Contact being pinged, nil if none
+	prefix       KademliaID
+	depth        int
+	size         int
+	lastActivity time.Time
 }
 
-// newBucket returns a new instance of a bucket
-func newBucket() *bucket {
-	bucket := &bucket{}
+// newBucket returns a new instance of a bucket holding at most size contacts
+// and covering the whole ID space
+func newBucket(size int) *bucket {
+	bucket := &bucket{size: size, lastActivity: time.Now()}
 	bucket.list = list.New()
+	bucket.replacements = list.New()
+	bucket.lastSeen = make(map[KademliaID]time.Time)
 	return bucket
 }
 
-// AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
-func (bucket *bucket) AddContact(contact Contact) {
-	var element *list.Element
+// contains returns true if the id falls in the range covered by the bucket
+func (bucket *bucket) contains(id *KademliaID) bool {
+	for i := 0; i < bucket.depth; i++ {
+		if id.bit(i) != bucket.prefix.bit(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// split divides the bucket into two buckets one bit deeper, the first one
+// covering the IDs whose next bit is 0 and the second one those whose next bit is 1.
+// Contacts and replacements keep their order, and the half holding the Contact
+// being pinged keeps waiting for its answer
+func (bucket *bucket) split() (*bucket, *bucket) {
+	zero, one := newBucket(bucket.size), newBucket(bucket.size)
+	zero.prefix, one.prefix = bucket.prefix, bucket.prefix
+	one.prefix[bucket.depth/8] |= 0x80 >> uint(bucket.depth%8)
+	zero.depth, one.depth = bucket.depth+1, bucket.depth+1
+	zero.lastActivity, one.lastActivity = bucket.lastActivity, bucket.lastActivity
+	if bucket.pinging != nil {
+		if one.contains(bucket.pinging) {
+			one.pinging = bucket.pinging
+		} else {
+			zero.pinging = bucket.pinging
+		}
+	}
+	for id, seen := range bucket.lastSeen {
+		if one.contains(&id) {
+			one.lastSeen[id] = seen
+		} else {
+			zero.lastSeen[id] = seen
+		}
+	}
+
 	for e := bucket.list.Front(); e != nil; e = e.Next() {
-		nodeID := e.Value.(Contact).ID
+		contact := e.Value.(Contact)
+		if one.contains(contact.ID) {
+			one.list.PushBack(contact)
+		} else {
+			zero.list.PushBack(contact)
+		}
+	}
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		contact := e.Value.(Contact)
+		if one.contains(contact.ID) {
+			one.replacements.PushBack(contact)
+		} else {
+			zero.replacements.PushBack(contact)
+		}
+	}
+	return zero, one
+}
 
-		if (contact).ID.Equals(nodeID) {
-			element = e
+// hasContact returns true if the Contact with the given ID is in the bucket
+func (bucket *bucket) hasContact(id *KademliaID) bool {
+	return findElement(bucket.list, id) != nil
+}
+
+// AddContact adds the Contact to the front of the bucket
+// or moves it to the front of the bucket if it already existed,
+// updating its version and capabilities if the Contact knows them.
+// If the bucket is full the Contact is put in the replacement cache
+// and the least-recently seen Contact is returned so that it can be pinged,
+// unless a ping of that Contact is already in progress
+func (bucket *bucket) AddContact(contact Contact) *Contact {
+	bucket.touch()
+	bucket.lastSeen[*contact.ID] = bucket.lastActivity
+	element := findElement(bucket.list, contact.ID)
+	if element != nil {
+		if contact.Version > 0 {
+			existing := element.Value.(Contact)
+			existing.Version, existing.Capabilities = contact.Version, contact.Capabilities
+			element.Value = existing
 		}
+		bucket.list.MoveToFront(element)
+		return nil
+	}
+
+	if bucket.list.Len() < bucket.size {
+		bucket.list.PushFront(contact)
+		return nil
+	}
+
+	bucket.addReplacement(contact)
+	if bucket.pinging != nil {
+		return nil
+	}
+	leastRecentlySeen := bucket.list.Back().Value.(Contact)
+	bucket.pinging = leastRecentlySeen.ID
+	return &leastRecentlySeen
+}
+
+// ResolvePing ends the ping of the least-recently seen Contact started by AddContact.
+// If the Contact did not answer it is removed from the bucket and
+// replaced by the most recently seen Contact of the replacement cache
+func (bucket *bucket) ResolvePing(contact Contact, alive bool) {
+	if bucket.pinging != nil && bucket.pinging.Equals(contact.ID) {
+		bucket.pinging = nil
+	}
+	if !alive {
+		bucket.RemoveContact(contact.ID)
 	}
+}
 
+// RemoveContact removes the Contact with the given ID from the bucket and
+// replaces it by the most recently seen Contact of the replacement cache.
+// It returns false if the Contact was not in the bucket
+func (bucket *bucket) RemoveContact(id *KademliaID) bool {
+	element := findElement(bucket.list, id)
 	if element == nil {
-		if bucket.list.Len() < bucketSize {
-			bucket.list.PushFront(contact)
+		return false
+	}
+	bucket.list.Remove(element)
+	delete(bucket.lastSeen, *id)
+
+	if replacement := bucket.replacements.Front(); replacement != nil {
+		bucket.replacements.Remove(replacement)
+		bucket.list.PushFront(replacement.Value.(Contact))
+	}
+	return true
+}
+
+// addReplacement adds the Contact to the front of the replacement cache,
+// dropping the oldest candidate if the cache is full
+func (bucket *bucket) addReplacement(contact Contact) {
+	if element := findElement(bucket.replacements, contact.ID); element != nil {
+		bucket.replacements.Remove(element)
+	}
+	bucket.replacements.PushFront(contact)
+	if bucket.replacements.Len() > bucket.size {
+		dropped := bucket.replacements.Remove(bucket.replacements.Back()).(Contact)
+		delete(bucket.lastSeen, *dropped.ID)
+	}
+}
+
+// findElement returns the element of the list holding the Contact with the given ID
+func findElement(l *list.List, id *KademliaID) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if id.Equals(e.Value.(Contact).ID) {
+			return e
 		}
-	} else {
-		bucket.list.MoveToFront(element)
 	}
+	return nil
 }
 
 // GetContactAndCalcDistance returns an array of Contacts where
@@ -53,20 +191,39 @@ func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
 	return contacts
 }
 
+// candidates returns the Contacts of the bucket followed by those of the replacement cache
+func (bucket *bucket) candidates() []Contact {
+	contacts := make([]Contact, 0, bucket.list.Len()+bucket.replacements.Len())
+	for _, l := range []*list.List{bucket.list, bucket.replacements} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			contacts = append(contacts, e.Value.(Contact))
+		}
+	}
+	return contacts
+}
+
 // Len return the size of the bucket
 func (bucket *bucket) Len() int {
 	return bucket.list.Len()
 }
 
-// Refresh bucket the node selects a random number in that range and does a refresh, an iterativeFindNode using that number as key.
-func (bucket *bucket) getContactForBucketRefresh() Contact {
-	if bucket.list.Len() == 0 {
-		return Contact{ID: nil} // Return a contact with a nil ID
-	}
-	randomIndex := rand.Intn(bucket.list.Len())
-	element := bucket.list.Front()
-	for i := 0; i < randomIndex; i++ {
-		element = element.Next()
+// touch records activity in the range of the bucket
+func (bucket *bucket) touch() {
+	bucket.lastActivity = time.Now()
+}
+
+// idleSince returns true if nothing happened in the bucket since the given time
+func (bucket *bucket) idleSince(since time.Time) bool {
+	return bucket.lastActivity.Before(since)
+}
+
+// randomID returns a random ID in the range covered by the bucket, to look up
+// when refreshing it
+func (bucket *bucket) randomID() *KademliaID {
+	id := NewRandomKademliaID()
+	for i := 0; i < bucket.depth; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		id[i/8] = id[i/8]&^mask | bucket.prefix[i/8]&mask
 	}
-	return element.Value.(Contact)
+	return id
 }
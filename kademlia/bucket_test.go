@@ -0,0 +1,226 @@
+package kademlia
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fillBucket adds bucketSize contacts with distinct IDs to the bucket
+func fillBucket(b *bucket) []Contact {
+	contacts := make([]Contact, bucketSize)
+	for i := 0; i < bucketSize; i++ {
+		id := NewKademliaID(fmt.Sprintf("8%039x", i))
+		contacts[i] = NewContact(id, fmt.Sprintf("localhost:%d", 9000+i))
+		b.AddContact(contacts[i])
+	}
+	return contacts
+}
+
+// TestBucketFullReturnsLeastRecentlySeen verifies that a full bucket keeps its
+// contacts and asks for the least-recently seen one to be pinged.
+func TestBucketFullReturnsLeastRecentlySeen(t *testing.T) {
+	b := newBucket(bucketSize)
+	contacts := fillBucket(b)
+
+	newcomer := NewContact(NewKademliaID("ffffffffffffffffffffffffffffffffffffffff"), "localhost:9999")
+	head := b.AddContact(newcomer)
+
+	if head == nil {
+		t.Fatal("Expected the least-recently seen contact to be returned for a full bucket")
+	}
+	if !head.ID.Equals(contacts[0].ID) {
+		t.Errorf("Expected %s to be pinged, got %s", contacts[0].ID, head.ID)
+	}
+	if b.Len() != bucketSize {
+		t.Errorf("Expected bucket to stay at %d contacts, got %d", bucketSize, b.Len())
+	}
+	if b.replacements.Len() != 1 {
+		t.Errorf("Expected the newcomer to be in the replacement cache")
+	}
+
+	// A second newcomer should not trigger another ping while one is in progress
+	other := NewContact(NewKademliaID("fffffffffffffffffffffffffffffffffffffffe"), "localhost:9998")
+	if b.AddContact(other) != nil {
+		t.Errorf("Expected no new ping while the head is already being pinged")
+	}
+}
+
+// TestBucketResolvePing verifies that a dead head is replaced by the most
+// recently seen replacement and that a live head is kept.
+func TestBucketResolvePing(t *testing.T) {
+	t.Run("Dead head is evicted", func(t *testing.T) {
+		b := newBucket(bucketSize)
+		contacts := fillBucket(b)
+		older := NewContact(NewKademliaID("fffffffffffffffffffffffffffffffffffffffe"), "localhost:9998")
+		newer := NewContact(NewKademliaID("ffffffffffffffffffffffffffffffffffffffff"), "localhost:9999")
+		head := b.AddContact(older)
+		b.AddContact(newer)
+
+		b.ResolvePing(*head, false)
+
+		if findElement(b.list, contacts[0].ID) != nil {
+			t.Errorf("Expected dead head to be removed from the bucket")
+		}
+		if front := b.list.Front().Value.(Contact); !front.ID.Equals(newer.ID) {
+			t.Errorf("Expected most recently seen replacement at the front, got %s", front.ID)
+		}
+		if b.Len() != bucketSize || b.replacements.Len() != 1 {
+			t.Errorf("Expected %d contacts and 1 replacement, got %d and %d", bucketSize, b.Len(), b.replacements.Len())
+		}
+	})
+
+	t.Run("Live head is kept", func(t *testing.T) {
+		b := newBucket(bucketSize)
+		contacts := fillBucket(b)
+		head := b.AddContact(NewContact(NewKademliaID("ffffffffffffffffffffffffffffffffffffffff"), "localhost:9999"))
+
+		b.ResolvePing(*head, true)
+
+		if findElement(b.list, contacts[0].ID) == nil {
+			t.Errorf("Expected live head to stay in the bucket")
+		}
+		if b.pinging != nil {
+			t.Errorf("Expected ping to be resolved")
+		}
+	})
+}
+
+// TestSplitKeepsPing verifies that a ping in progress is kept by the half
+// of a split bucket holding the pinged contact, and only by that half.
+func TestSplitKeepsPing(t *testing.T) {
+	b := newBucket(bucketSize)
+	contacts := fillBucket(b)
+	head := b.AddContact(NewContact(NewKademliaID("ffffffffffffffffffffffffffffffffffffffff"), "localhost:9999"))
+
+	zero, one := b.split()
+	if zero.pinging != nil {
+		t.Errorf("Expected no ping in progress in the half without the pinged contact")
+	}
+	if one.pinging == nil || !one.pinging.Equals(head.ID) {
+		t.Fatalf("Expected the ping of %s to be kept by the half holding it", head.ID)
+	}
+	if one.AddContact(NewContact(NewKademliaID("fffffffffffffffffffffffffffffffffffffffe"), "localhost:9998")) != nil {
+		t.Errorf("Expected no second ping of the same contact after the split")
+	}
+
+	one.ResolvePing(*head, false)
+	if one.pinging != nil || findElement(one.list, contacts[0].ID) != nil {
+		t.Errorf("Expected the ping to be resolved and the dead contact removed")
+	}
+}
+
+// TestBucketReplacementCacheBounded verifies that the replacement cache never
+// grows beyond the bucket size.
+func TestBucketReplacementCacheBounded(t *testing.T) {
+	b := newBucket(bucketSize)
+	fillBucket(b)
+	for i := 0; i < 2*bucketSize; i++ {
+		b.AddContact(NewContact(NewKademliaID(fmt.Sprintf("f%039x", i)), "localhost:9999"))
+	}
+	if b.replacements.Len() != bucketSize {
+		t.Errorf("Expected replacement cache of %d, got %d", bucketSize, b.replacements.Len())
+	}
+}
+
+// TestEvictDeadContact verifies that a node pings the head of a full bucket
+// and evicts it in favour of the newcomer when it does not answer.
+func TestEvictDeadContact(t *testing.T) {
+	sim := NewSimulatedNetwork()
+	node := NewTestKademliaNode("node", sim, DefaultConfig())
+
+	// Flipping the first bit puts every contact in the same bucket
+	var dead []Contact
+	for i := 0; i < bucketSize; i++ {
+		id := *NewRandomKademliaID()
+		id[0] = node.Self.ID[0] ^ 0x80
+		contact := NewContact(&id, fmt.Sprintf("dead%d", i))
+		dead = append(dead, contact)
+		node.updateRoutingTable(contact)
+	}
+
+	newcomerID := *NewRandomKademliaID()
+	newcomerID[0] = node.Self.ID[0] ^ 0x80
+	newcomer := NewTestKademliaNode("newcomer", sim, DefaultConfig())
+	newcomer.Self.ID = &newcomerID
+	node.updateRoutingTable(newcomer.Self)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		ids := getContactIDs(node.RoutingTable.FindClosestContacts(&newcomerID, 2*bucketSize))
+		if containsID(ids, newcomerID.String()) && !containsID(ids, dead[0].ID.String()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the dead head to be replaced by the newcomer")
+}
+
+func containsID(ids []string, id string) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// TestBucketRandomID verifies that the IDs used to refresh a bucket lie in its range.
+func TestBucketRandomID(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTable(me)
+	splitOwnBucket(rt, 12)
+
+	for i := 0; i < rt.BucketCount(); i++ {
+		target := rt.RefreshTarget(i)
+		if rt.BucketIndex(target) != i {
+			t.Errorf("Refresh target %s of bucket %d lies in bucket %d", target, i, rt.BucketIndex(target))
+		}
+	}
+	if rt.RefreshTarget(rt.BucketCount()) != nil {
+		t.Errorf("Expected no refresh target for a bucket that does not exist")
+	}
+}
+
+// TestIdleBucketsAreRefreshed verifies that the background refresh looks up
+// idle buckets and thereby learns new contacts.
+func TestIdleBucketsAreRefreshed(t *testing.T) {
+	sim := NewSimulatedNetwork()
+	config := DefaultConfig()
+	config.RefreshInterval = 50 * time.Millisecond
+	nodeA := NewTestKademliaNode("nodeA", sim, config)
+	nodeB := NewTestKademliaNode("nodeB", sim, config)
+	nodeC := NewTestKademliaNode("nodeC", sim, config)
+	defer nodeA.Close()
+	defer nodeB.Close()
+	defer nodeC.Close()
+
+	// A → B → C, A only learns about C through a refresh
+	nodeA.RoutingTable.AddContact(nodeB.Self)
+	nodeB.RoutingTable.AddContact(nodeC.Self)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ids := getContactIDs(nodeA.RoutingTable.FindClosestContacts(nodeC.Self.ID, bucketSize))
+		if containsID(ids, nodeC.Self.ID.String()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected nodeA to learn about nodeC by refreshing its buckets")
+}
+
+// TestActiveBucketsAreNotRefreshed verifies that only idle buckets are returned for refresh.
+func TestActiveBucketsAreNotRefreshed(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTable(me)
+	splitOwnBucket(rt, 3)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	rt.Touch(idWithCommonPrefix(1, 0))
+
+	if n := len(rt.IdleBuckets(since)); n != rt.BucketCount()-1 {
+		t.Errorf("Expected %d idle buckets, got %d", rt.BucketCount()-1, n)
+	}
+}
@@ -0,0 +1,261 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec turns messages into the bytes sent over the network and back
+type Codec interface {
+	Encode(msg *Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+// Names of the codecs, for Config.Codec
+const (
+	JSONCodecName   = "json"
+	BinaryCodecName = "binary"
+)
+
+// CodecByName returns the codec with the given name, JSONCodec if the name is empty
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "", JSONCodecName:
+		return JSONCodec{}, nil
+	case BinaryCodecName:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// SniffCodec returns the codec that encoded the message, from its first byte
+func SniffCodec(data []byte) Codec {
+	if len(data) > 0 && data[0] == binaryMagic {
+		return BinaryCodec{}
+	}
+	return JSONCodec{}
+}
+
+// codecFor returns the codec to encode a message to the contact with: the preferred
+// codec if the contact decodes it, JSON which every version decodes otherwise.
+// Peers only decoding the binary messages of version 1 are sent JSON as well
+func codecFor(preferred Codec, contact Contact) Codec {
+	if _, binary := preferred.(BinaryCodec); binary && !contact.Supports(CapBinaryCodec|CapSignedMessages) {
+		return JSONCodec{}
+	}
+	return preferred
+}
+
+// JSONCodec encodes messages as JSON objects, the payload being base64 encoded
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (JSONCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// binaryMagic starts every message encoded by BinaryCodec, it can never start a JSON message
+const binaryMagic byte = 0xD7
+
+// BinaryVersion is the latest version of the layout written by BinaryCodec. Messages
+// without the version and capabilities of the sender are written in version 2, which
+// peers that do not advertise CapSenderHeader decode. Version 1 has no signature,
+// it is still decoded
+const BinaryVersion byte = 3
+
+// ErrBinaryVersion is returned when decoding a binary message of a version we do not know
+var ErrBinaryVersion = errors.New("unsupported binary message version")
+
+// messageTypeCodes numbers the message types in binary messages, the numbers must never change
+var messageTypeCodes = map[MessageType]byte{
+	PING:                1,
+	PONG:                2,
+	STORE:               3,
+	STORE_RESPONSE:      4,
+	FIND_NODE_REQUEST:   5,
+	FIND_NODE_RESPONSE:  6,
+	FIND_VALUE:          7,
+	FIND_VALUE_RESPONSE: 8,
+}
+
+// BinaryCodec encodes messages in a compact layout. Every variable length field
+// is prefixed by its length as an unsigned varint:
+//
+//	magic     1 byte, 0xD7
+//	version   1 byte, BinaryVersion
+//	type      1 byte, see messageTypeCodes
+//	from      contact: length-prefixed ID (empty if unknown), length-prefixed address
+//	to        contact
+//	sender    unsigned varint version and capabilities of the sender, since version 3
+//	rpc id    20 bytes
+//	payload   length-prefixed
+//	key       length-prefixed public key
+//	signature length-prefixed, since version 2
+type BinaryCodec struct{}
+
+func (BinaryCodec) Encode(msg *Message) ([]byte, error) {
+	code, ok := messageTypeCodes[msg.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	data := make([]byte, 0, 128+len(msg.Payload)+len(msg.PublicKey)+len(msg.Signature))
+	version := BinaryVersion
+	if msg.Version == 0 && msg.Capabilities == 0 {
+		version = 2
+	}
+	data = append(data, binaryMagic, version, code)
+	data = appendContact(data, msg.From)
+	data = appendContact(data, msg.To)
+	if version >= 3 {
+		data = binary.AppendUvarint(data, uint64(msg.Version))
+		data = binary.AppendUvarint(data, uint64(msg.Capabilities))
+	}
+	data = append(data, msg.RPCID[:]...)
+	data = appendBytes(data, msg.Payload)
+	data = appendBytes(data, msg.PublicKey)
+	data = appendBytes(data, msg.Signature)
+	return data, nil
+}
+
+func (BinaryCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	reader := binaryReader{data: data}
+	magic, version, code := reader.byte(), reader.byte(), reader.byte()
+	if reader.err != nil {
+		return msg, reader.err
+	}
+	if magic != binaryMagic {
+		return msg, fmt.Errorf("not a binary message, starts with %#x", magic)
+	}
+	if version < 1 || version > BinaryVersion {
+		return msg, fmt.Errorf("%w %d", ErrBinaryVersion, version)
+	}
+	for messageType, c := range messageTypeCodes {
+		if c == code {
+			msg.Type = messageType
+		}
+	}
+	if msg.Type == "" {
+		return msg, fmt.Errorf("unknown message type code %d", code)
+	}
+	msg.From = reader.contact()
+	msg.To = reader.contact()
+	if version >= 3 {
+		msg.Version = int(reader.uvarint())
+		msg.Capabilities = Capability(reader.uvarint())
+	}
+	copy(msg.RPCID[:], reader.fixed(IDLength))
+	msg.Payload = reader.bytes()
+	msg.PublicKey = reader.bytes()
+	if version >= 2 {
+		msg.Signature = reader.bytes()
+	}
+	if reader.err == nil && reader.off != len(data) {
+		reader.err = fmt.Errorf("%d bytes after the end of the message", len(data)-reader.off)
+	}
+	return msg, reader.err
+}
+
+// appendBytes appends b prefixed by its length
+func appendBytes(data []byte, b []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(b)))
+	return append(data, b...)
+}
+
+// appendContact appends the ID, or nothing if it is unknown, and the address of the contact
+func appendContact(data []byte, contact Contact) []byte {
+	var id []byte
+	if contact.ID != nil {
+		id = contact.ID[:]
+	}
+	data = appendBytes(data, id)
+	return appendBytes(data, []byte(contact.Address))
+}
+
+// binaryReader reads the fields of a binary message, after the
+// first error every read returns a zero value and err is kept
+type binaryReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (reader *binaryReader) fixed(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if n > len(reader.data)-reader.off {
+		reader.err = errors.New("truncated binary message")
+		return nil
+	}
+	b := reader.data[reader.off : reader.off+n]
+	reader.off += n
+	return b
+}
+
+func (reader *binaryReader) byte() byte {
+	b := reader.fixed(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (reader *binaryReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.data[reader.off:])
+	if n <= 0 {
+		reader.err = errors.New("invalid varint in binary message")
+		return 0
+	}
+	reader.off += n
+	return value
+}
+
+// bytes reads a length-prefixed field, nil if it is empty
+func (reader *binaryReader) bytes() []byte {
+	if reader.err != nil {
+		return nil
+	}
+	length, n := binary.Uvarint(reader.data[reader.off:])
+	if n <= 0 {
+		reader.err = errors.New("invalid length in binary message")
+		return nil
+	}
+	reader.off += n
+	if length > uint64(len(reader.data)-reader.off) {
+		reader.err = errors.New("truncated binary message")
+		return nil
+	}
+	if length == 0 {
+		return nil
+	}
+	b := make([]byte, length)
+	copy(b, reader.fixed(int(length)))
+	return b
+}
+
+func (reader *binaryReader) contact() Contact {
+	var contact Contact
+	if id := reader.bytes(); id != nil {
+		if len(id) != IDLength {
+			if reader.err == nil {
+				reader.err = fmt.Errorf("contact ID of %d bytes", len(id))
+			}
+			return contact
+		}
+		contact.ID = &KademliaID{}
+		copy(contact.ID[:], id)
+	}
+	contact.Address = string(reader.bytes())
+	return contact
+}
@@ -0,0 +1,149 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// goldenMessages are encoded to the files of testdata, changing them changes the wire format
+var goldenMessages = map[string]*Message{
+	"store": NewStoreMessage(
+		NewContact(NewKademliaID("00112233445566778899aabbccddeeff00112233"), "10.0.0.1:8000"),
+		*NewKademliaID("0102030405060708090a0b0c0d0e0f1011121314"),
+		NewContact(NewKademliaID("ffeeddccbbaa99887766554433221100ffeeddcc"), "10.0.0.2:8000"),
+		"hello"),
+	"store-sender": {
+		Type:         STORE,
+		From:         NewContact(NewKademliaID("00112233445566778899aabbccddeeff00112233"), "10.0.0.1:8000"),
+		To:           NewContact(NewKademliaID("ffeeddccbbaa99887766554433221100ffeeddcc"), "10.0.0.2:8000"),
+		RPCID:        *NewKademliaID("0102030405060708090a0b0c0d0e0f1011121314"),
+		Payload:      []byte(`"hello"`),
+		Version:      ProtocolVersion,
+		Capabilities: CapBinaryCodec | CapSignedMessages | CapSenderHeader,
+	},
+	"ping-unknown-id": {
+		Type:      PING,
+		From:      NewContact(NewKademliaID("00112233445566778899aabbccddeeff00112233"), "10.0.0.1:8000"),
+		To:        Contact{Address: "10.0.0.2:8000"},
+		RPCID:     *NewKademliaID("0102030405060708090a0b0c0d0e0f1011121314"),
+		PublicKey: bytes.Repeat([]byte{0xab}, 32),
+		Signature: bytes.Repeat([]byte{0xcd}, 64),
+	},
+}
+
+func TestCodecGolden(t *testing.T) {
+	codecs := map[string]Codec{"json": JSONCodec{}, "bin": BinaryCodec{}}
+	for name, msg := range goldenMessages {
+		for ext, codec := range codecs {
+			t.Run(name+"."+ext, func(t *testing.T) {
+				path := filepath.Join("testdata", name+"."+ext)
+				data, err := codec.Encode(msg)
+				require.NoError(t, err)
+				if *updateGolden {
+					require.NoError(t, os.WriteFile(path, data, 0o644))
+				}
+
+				golden, err := os.ReadFile(path)
+				require.NoError(t, err)
+				assert.Equal(t, golden, data, "Encoding changed, run the tests with -update if it is intended")
+
+				decoded, err := codec.Decode(golden)
+				require.NoError(t, err)
+				assert.Equal(t, msg.Type, decoded.Type)
+				assert.Equal(t, msg.From, decoded.From)
+				assert.Equal(t, msg.To, decoded.To)
+				assert.Equal(t, msg.RPCID, decoded.RPCID)
+				assert.Equal(t, string(msg.Payload), string(decoded.Payload))
+				assert.Equal(t, msg.PublicKey, decoded.PublicKey)
+				assert.Equal(t, msg.Signature, decoded.Signature)
+				assert.Equal(t, msg.Version, decoded.Version)
+				assert.Equal(t, msg.Capabilities, decoded.Capabilities)
+			})
+		}
+	}
+}
+
+func TestBinaryCodecVersion1(t *testing.T) {
+	golden, err := os.ReadFile(filepath.Join("testdata", "store.v1.bin"))
+	require.NoError(t, err)
+	require.Equal(t, byte(1), golden[1])
+
+	msg := goldenMessages["store"]
+	decoded, err := BinaryCodec{}.Decode(golden)
+	require.NoError(t, err, "Messages of version 1 should still be decoded")
+	assert.Equal(t, msg.From, decoded.From)
+	assert.Equal(t, string(msg.Payload), string(decoded.Payload))
+	assert.Nil(t, decoded.Signature)
+}
+
+func TestBinaryCodec(t *testing.T) {
+	msg := goldenMessages["store"]
+	data, err := BinaryCodec{}.Encode(msg)
+	require.NoError(t, err)
+
+	t.Run("Smaller than JSON", func(t *testing.T) {
+		jsonData, err := JSONCodec{}.Encode(msg)
+		require.NoError(t, err)
+		assert.Less(t, len(data), len(jsonData)/2)
+	})
+
+	t.Run("Truncated messages are rejected", func(t *testing.T) {
+		for i := 0; i < len(data); i++ {
+			_, err := BinaryCodec{}.Decode(data[:i])
+			assert.Error(t, err, "Decoding the first %d bytes should fail", i)
+		}
+	})
+
+	t.Run("Unknown versions are rejected", func(t *testing.T) {
+		future := bytes.Clone(data)
+		future[1] = BinaryVersion + 1
+		_, err := BinaryCodec{}.Decode(future)
+		assert.ErrorIs(t, err, ErrBinaryVersion)
+	})
+
+	t.Run("JSON is not mistaken for a binary message", func(t *testing.T) {
+		jsonData, _ := JSONCodec{}.Encode(msg)
+		_, err := BinaryCodec{}.Decode(jsonData)
+		assert.Error(t, err)
+	})
+
+	t.Run("Codec names", func(t *testing.T) {
+		codec, err := CodecByName(BinaryCodecName)
+		require.NoError(t, err)
+		assert.Equal(t, BinaryCodec{}, codec)
+		codec, err = CodecByName("")
+		require.NoError(t, err)
+		assert.Equal(t, JSONCodec{}, codec)
+		_, err = CodecByName("xml")
+		assert.Error(t, err)
+	})
+}
+
+func TestBinaryCodecOverUDP(t *testing.T) {
+	config := DefaultConfig()
+	config.Codec = BinaryCodecName
+	nodeA, err := NewKademliaNode("127.0.0.1", 8201, config)
+	require.NoError(t, err)
+	defer nodeA.Close()
+	nodeB, err := NewKademliaNode("127.0.0.1", 8202, config)
+	require.NoError(t, err)
+	defer nodeB.Close()
+
+	require.NoError(t, nodeA.SendPing(&nodeB.Self))
+	contacts, err := nodeB.FindNodeContext(context.Background(), &nodeA.Self, nodeB.Self.ID)
+	require.NoError(t, err)
+	assert.Contains(t, getIDs(contacts), nodeB.Self.ID.String())
+
+	config.Codec = "xml"
+	_, err = NewKademliaNode("127.0.0.1", 8203, config)
+	assert.Error(t, err, "Unknown codecs should be refused")
+}
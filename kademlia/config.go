@@ -0,0 +1,76 @@
+package kademlia
+
+import "time"
+
+// Config holds the tunable parameters of a Kademlia node
+type Config struct {
+	K               int           // Bucket size and replication factor
+	Alpha           int           // Number of concurrent RPCs in a lookup
+	B               int           // Branching factor of the routing tree
+	RPCTimeout      time.Duration // Time to wait for the answer to an RPC
+	StaleTimeout    time.Duration // Time after which a lookup queries another contact instead of waiting on a slow one
+	TTL             time.Duration // Time a stored value lives without being requested
+	RefreshInterval time.Duration // Time after which an idle bucket is refreshed
+	MaxFailures     int           // Consecutive timeouts after which a contact is removed
+	DataDir         string        // Directory where the node ID and routing table are kept, none if empty
+	VerifiableID    bool          // Use the hash of the ed25519 public key of the node as node ID
+	RequireKeys     bool          // Drop messages from peers whose ID is not the hash of their public key, else the check is best-effort
+	NoLocalCopy     bool          // Keep no copy of the values put by this node, else a copy that never expires is kept
+	Codec           string        // Encoding of the messages sent, JSONCodecName or BinaryCodecName
+	Encrypt         bool          // Encrypt the messages sent over UDP and drop the ones received in the clear
+
+	// Limits on contacts sharing an IP address or a /24 (/64 for IPv6) subnet, 0 means no limit
+	MaxPerIPInBucket     int
+	MaxPerSubnetInBucket int
+	MaxPerIPInTable      int
+	MaxPerSubnetInTable  int
+}
+
+// DefaultConfig returns the parameters suggested by the Kademlia paper
+func DefaultConfig() Config {
+	return Config{
+		K:               bucketSize,
+		Alpha:           3,
+		B:               1,
+		RPCTimeout:      3 * time.Second,
+		StaleTimeout:    500 * time.Millisecond,
+		TTL:             24 * time.Hour,
+		RefreshInterval: time.Hour,
+		MaxFailures:     3,
+		Codec:           JSONCodecName,
+	}
+}
+
+// withDefaults returns a copy of the Config where every unset parameter
+// is replaced by its default value
+func (config Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if config.K <= 0 {
+		config.K = defaults.K
+	}
+	if config.Alpha <= 0 {
+		config.Alpha = defaults.Alpha
+	}
+	if config.B <= 0 {
+		config.B = defaults.B
+	}
+	if config.RPCTimeout <= 0 {
+		config.RPCTimeout = defaults.RPCTimeout
+	}
+	if config.StaleTimeout <= 0 {
+		config.StaleTimeout = defaults.StaleTimeout
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaults.TTL
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaults.RefreshInterval
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaults.MaxFailures
+	}
+	if config.Codec == "" {
+		config.Codec = defaults.Codec
+	}
+	return config
+}
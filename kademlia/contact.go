@@ -6,16 +6,25 @@ import (
 )
 
 // Contact definition
-// stores the KademliaID, the ip address and the distance
+// stores the KademliaID, the ip address and the distance.
+// The version and capabilities are only learned from the peer itself,
+// in PING and PONG, and are never sent as part of a contact
 type Contact struct {
-	ID       *KademliaID
-	Address  string
-	distance *KademliaID
+	ID           *KademliaID
+	Address      string
+	Version      int        `json:"-"` // Protocol version of the peer, 0 if unknown
+	Capabilities Capability `json:"-"`
+	distance     *KademliaID
 }
 
 // NewContact returns a new instance of a Contact
 func NewContact(id *KademliaID, address string) Contact {
-	return Contact{id, address, nil}
+	return Contact{ID: id, Address: address}
+}
+
+// Supports returns true if the peer advertised the capability
+func (contact *Contact) Supports(capability Capability) bool {
+	return contact.Capabilities.Has(capability)
 }
 
 // CalcDistance calculates the distance to the target and
@@ -0,0 +1,108 @@
+package kademlia
+
+import "net"
+
+// RoutingTableStats holds counters describing the routing table
+type RoutingTableStats struct {
+	Contacts int `json:"contacts"`
+	Buckets  int `json:"buckets"`
+
+	// Contacts rejected because too many contacts share their IP
+	// address or subnet, in the same bucket or in the whole table
+	RejectedIPInBucket     int `json:"rejectedIPInBucket"`
+	RejectedSubnetInBucket int `json:"rejectedSubnetInBucket"`
+	RejectedIPInTable      int `json:"rejectedIPInTable"`
+	RejectedSubnetInTable  int `json:"rejectedSubnetInTable"`
+}
+
+// diversityLimits bounds the number of contacts sharing an IP address or
+// subnet, so that one host running many nodes cannot take over a bucket
+type diversityLimits struct {
+	ipInBucket     int
+	subnetInBucket int
+	ipInTable      int
+	subnetInTable  int
+}
+
+// networkOf returns the IP address of a contact and its /24 subnet,
+// or /64 for IPv6. ok is false if the address does not hold an IP,
+// such contacts are not subject to the limits
+func networkOf(address string) (ip string, subnet string, ok bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		return "", "", false
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String(), v4.Mask(net.CIDRMask(24, 32)).String(), true
+	}
+	return parsed.String(), parsed.Mask(net.CIDRMask(64, 128)).String(), true
+}
+
+// countNetwork returns how many of the contacts, other than the one with the
+// given ID, share the IP address and the subnet
+func countNetwork(contacts []Contact, id *KademliaID, ip string, subnet string) (sameIP int, sameSubnet int) {
+	for _, contact := range contacts {
+		contactIP, contactSubnet, ok := networkOf(contact.Address)
+		if !ok || contact.ID.Equals(id) {
+			continue
+		}
+		if contactIP == ip {
+			sameIP++
+		}
+		if contactSubnet == subnet {
+			sameSubnet++
+		}
+	}
+	return sameIP, sameSubnet
+}
+
+// admits checks a contact that is not in the bucket yet against the limits of
+// the bucket and of the whole table. A rejected contact is counted in the stats
+func (routingTable *RoutingTable) admits(contact Contact, bucket *bucket) bool {
+	limits := routingTable.limits
+	if limits == (diversityLimits{}) || bucket.hasContact(contact.ID) {
+		return true
+	}
+	ip, subnet, ok := networkOf(contact.Address)
+	if !ok {
+		return true
+	}
+
+	// The replacement cache counts too, its contacts may take a place in the bucket
+	sameIP, sameSubnet := countNetwork(bucket.candidates(), contact.ID, ip, subnet)
+	if exceeds(sameIP, limits.ipInBucket) {
+		routingTable.stats.RejectedIPInBucket++
+		return false
+	}
+	if exceeds(sameSubnet, limits.subnetInBucket) {
+		routingTable.stats.RejectedSubnetInBucket++
+		return false
+	}
+
+	if limits.ipInTable > 0 || limits.subnetInTable > 0 {
+		var inTable []Contact
+		for _, bucket := range routingTable.buckets {
+			inTable = append(inTable, bucket.candidates()...)
+		}
+		sameIP, sameSubnet = countNetwork(inTable, contact.ID, ip, subnet)
+		if exceeds(sameIP, limits.ipInTable) {
+			routingTable.stats.RejectedIPInTable++
+			return false
+		}
+		if exceeds(sameSubnet, limits.subnetInTable) {
+			routingTable.stats.RejectedSubnetInTable++
+			return false
+		}
+	}
+	return true
+}
+
+// exceeds returns true if adding one more contact would go over the limit, 0 means no limit
+func exceeds(count int, limit int) bool {
+	return limit > 0 && count >= limit
+}
@@ -0,0 +1,190 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fragmentPacket starts every fragment, it can start no other packet
+const fragmentPacket byte = 0xE4
+
+const (
+	maxDatagramSize    = 1200            // Largest packet sent in one datagram to peers that reassemble fragments
+	maxFragments       = 256             // Fragments a message may be split into
+	reassemblyTimeout  = 5 * time.Second // Time to receive every fragment of a message
+	maxReassemblyBytes = 4 << 20         // Bytes kept for the messages being reassembled
+	maxPartialMessages = 256             // Messages being reassembled at once
+	maxPeerBytes       = 1 << 20         // Bytes kept for the messages of one address being reassembled
+	maxPeerMessages    = 16              // Messages of one address being reassembled at once
+	maxReadSize        = 65535           // Largest datagram read, the largest UDP payload
+	fragmentHeaderSize = 1 + 4 + 2 + 2   // kind, message id, index, count
+	fragmentDataSize   = maxDatagramSize - fragmentHeaderSize
+)
+
+// fragment splits the packet into datagrams of at most maxDatagramSize bytes:
+//
+//	kind  1 byte, fragmentPacket
+//	id    4 bytes, same for every fragment of the packet
+//	index 2 bytes, position of the fragment
+//	count 2 bytes, number of fragments
+//	data  the bytes of the packet
+func fragment(packet []byte, id uint32) ([][]byte, error) {
+	count := (len(packet) + fragmentDataSize - 1) / fragmentDataSize
+	if count > maxFragments {
+		return nil, fmt.Errorf("message of %d bytes is too large to be sent", len(packet))
+	}
+
+	fragments := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		data := packet[index*fragmentDataSize : min((index+1)*fragmentDataSize, len(packet))]
+		fragment := make([]byte, 0, fragmentHeaderSize+len(data))
+		fragment = append(fragment, fragmentPacket)
+		fragment = binary.BigEndian.AppendUint32(fragment, id)
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(index))
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(count))
+		fragments = append(fragments, append(fragment, data...))
+	}
+	return fragments, nil
+}
+
+type fragmentKey struct {
+	address string
+	id      uint32
+}
+
+// partialMessage holds the fragments of a message received so far
+type partialMessage struct {
+	parts   [][]byte
+	missing int
+	size    int
+	created time.Time
+}
+
+// reassembler puts the fragments received back together. Messages that are not complete
+// after reassemblyTimeout are dropped, and so are the oldest ones when the fragments
+// kept would take more than maxReassemblyBytes or maxPartialMessages are incomplete.
+// The oldest messages of an address are dropped first when the address goes over
+// maxPeerBytes or maxPeerMessages, so that one peer cannot evict the messages of others
+type reassembler struct {
+	mu       sync.Mutex
+	messages map[fragmentKey]*partialMessage
+	size     int
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{messages: make(map[fragmentKey]*partialMessage)}
+}
+
+// add keeps the fragment received from the address, and returns the
+// packet it was part of once every fragment was received, nil before
+func (reassembler *reassembler) add(address string, fragment []byte, now time.Time) ([]byte, error) {
+	if len(fragment) <= fragmentHeaderSize {
+		return nil, errors.New("truncated fragment")
+	}
+	key := fragmentKey{address: address, id: binary.BigEndian.Uint32(fragment[1:])}
+	index := int(binary.BigEndian.Uint16(fragment[5:]))
+	count := int(binary.BigEndian.Uint16(fragment[7:]))
+	data := fragment[fragmentHeaderSize:]
+	if count == 0 || count > maxFragments || index >= count {
+		return nil, fmt.Errorf("fragment %d of %d", index, count)
+	}
+
+	reassembler.mu.Lock()
+	defer reassembler.mu.Unlock()
+
+	reassembler.expire(now)
+	message := reassembler.messages[key]
+	if message == nil {
+		if count == 1 {
+			return append([]byte{}, data...), nil
+		}
+		if messages, _ := reassembler.usage(address); messages >= maxPeerMessages {
+			reassembler.removeOldest(key, true)
+		}
+		if len(reassembler.messages) >= maxPartialMessages {
+			reassembler.removeOldest(key, false)
+		}
+		message = &partialMessage{parts: make([][]byte, count), missing: count, created: now}
+		reassembler.messages[key] = message
+	}
+	if len(message.parts) != count {
+		reassembler.remove(key, message)
+		return nil, fmt.Errorf("fragment counts %d and %d for the same message", len(message.parts), count)
+	}
+	if message.parts[index] != nil {
+		return nil, nil
+	}
+
+	_, peerSize := reassembler.usage(address)
+	for peerSize+len(data) > maxPeerBytes && reassembler.removeOldest(key, true) {
+		_, peerSize = reassembler.usage(address)
+	}
+	for reassembler.size+len(data) > maxReassemblyBytes && reassembler.removeOldest(key, false) {
+	}
+	if peerSize+len(data) > maxPeerBytes || reassembler.size+len(data) > maxReassemblyBytes {
+		reassembler.remove(key, message)
+		return nil, errors.New("no room to reassemble the message")
+	}
+	message.parts[index] = append([]byte{}, data...)
+	message.missing--
+	message.size += len(data)
+	reassembler.size += len(data)
+	if message.missing > 0 {
+		return nil, nil
+	}
+
+	reassembler.remove(key, message)
+	packet := make([]byte, 0, message.size)
+	for _, part := range message.parts {
+		packet = append(packet, part...)
+	}
+	return packet, nil
+}
+
+// expire drops the messages that were not completed in time
+func (reassembler *reassembler) expire(now time.Time) {
+	for key, message := range reassembler.messages {
+		if now.Sub(message.created) > reassemblyTimeout {
+			reassembler.remove(key, message)
+		}
+	}
+}
+
+// usage returns the number of messages of the address being reassembled and their size
+func (reassembler *reassembler) usage(address string) (messages int, size int) {
+	for key, message := range reassembler.messages {
+		if key.address == address {
+			messages++
+			size += message.size
+		}
+	}
+	return messages, size
+}
+
+// removeOldest drops the oldest message other than keep, only among the messages of the
+// address of keep if samePeer. It returns false if there is none
+func (reassembler *reassembler) removeOldest(keep fragmentKey, samePeer bool) bool {
+	var oldestKey fragmentKey
+	var oldest *partialMessage
+	for key, message := range reassembler.messages {
+		if key == keep || (samePeer && key.address != keep.address) {
+			continue
+		}
+		if oldest == nil || message.created.Before(oldest.created) {
+			oldestKey, oldest = key, message
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	reassembler.remove(oldestKey, oldest)
+	return true
+}
+
+func (reassembler *reassembler) remove(key fragmentKey, message *partialMessage) {
+	delete(reassembler.messages, key)
+	reassembler.size -= message.size
+}
@@ -0,0 +1,174 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragments(t *testing.T) {
+	packet := make([]byte, 10*maxDatagramSize)
+	rand.Read(packet)
+	fragments, err := fragment(packet, 1)
+	require.NoError(t, err)
+	for _, fragment := range fragments {
+		assert.LessOrEqual(t, len(fragment), maxDatagramSize)
+	}
+
+	t.Run("Fragments are reassembled in any order", func(t *testing.T) {
+		reassembler := newReassembler()
+		now := time.Now()
+		shuffled := append([][]byte{}, fragments...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		shuffled = append(shuffled[:1], shuffled...)
+
+		var reassembled []byte
+		for i, fragment := range shuffled {
+			reassembled, err = reassembler.add("peer", fragment, now)
+			require.NoError(t, err)
+			if i < len(shuffled)-1 {
+				assert.Nil(t, reassembled, "Message should not be complete after %d fragments", i+1)
+			}
+		}
+		assert.Equal(t, packet, reassembled)
+		assert.Zero(t, reassembler.size)
+	})
+
+	t.Run("Fragments of other peers are not mixed", func(t *testing.T) {
+		reassembler := newReassembler()
+		now := time.Now()
+		for _, fragment := range fragments[1:] {
+			_, err := reassembler.add("peer", fragment, now)
+			require.NoError(t, err)
+		}
+		reassembled, err := reassembler.add("other", fragments[0], now)
+		require.NoError(t, err)
+		assert.Nil(t, reassembled)
+	})
+
+	t.Run("Incomplete messages time out", func(t *testing.T) {
+		reassembler := newReassembler()
+		now := time.Now()
+		for _, fragment := range fragments[1:] {
+			_, err := reassembler.add("peer", fragment, now)
+			require.NoError(t, err)
+		}
+		reassembled, err := reassembler.add("peer", fragments[0], now.Add(reassemblyTimeout+time.Second))
+		require.NoError(t, err)
+		assert.Nil(t, reassembled, "Fragments received before the timeout should be dropped")
+		assert.Len(t, reassembler.messages, 1)
+		assert.Equal(t, len(fragments[0])-fragmentHeaderSize, reassembler.size)
+	})
+
+	t.Run("Memory for partial messages is bounded", func(t *testing.T) {
+		reassembler := newReassembler()
+		now := time.Now()
+		for id := uint32(0); id < 4*maxPartialMessages; id++ {
+			fragments, err := fragment(bytes.Repeat([]byte{1}, maxFragments*fragmentDataSize), id)
+			require.NoError(t, err)
+			for _, fragment := range fragments[:maxFragments/2] {
+				_, err := reassembler.add("peer", fragment, now)
+				require.NoError(t, err)
+			}
+			require.LessOrEqual(t, reassembler.size, maxReassemblyBytes)
+			require.LessOrEqual(t, len(reassembler.messages), maxPartialMessages)
+		}
+	})
+
+	t.Run("One peer cannot evict the messages of others", func(t *testing.T) {
+		reassembler := newReassembler()
+		now := time.Now()
+		for _, fragment := range fragments[1:] {
+			_, err := reassembler.add("other", fragment, now)
+			require.NoError(t, err)
+		}
+		for id := uint32(0); id < 4*maxPartialMessages; id++ {
+			fragments, err := fragment(bytes.Repeat([]byte{1}, maxFragments*fragmentDataSize), id)
+			require.NoError(t, err)
+			for _, fragment := range fragments[:maxFragments/2] {
+				_, err := reassembler.add("peer", fragment, now.Add(time.Millisecond))
+				require.NoError(t, err)
+			}
+			messages, size := reassembler.usage("peer")
+			require.LessOrEqual(t, messages, maxPeerMessages)
+			require.LessOrEqual(t, size, maxPeerBytes)
+		}
+
+		reassembled, err := reassembler.add("other", fragments[0], now.Add(time.Millisecond))
+		require.NoError(t, err)
+		assert.Equal(t, packet, reassembled)
+	})
+
+	t.Run("Messages too large are refused", func(t *testing.T) {
+		_, err := fragment(make([]byte, maxFragments*fragmentDataSize+1), 1)
+		assert.Error(t, err)
+	})
+
+	t.Run("Malformed fragments are refused", func(t *testing.T) {
+		reassembler := newReassembler()
+		_, err := reassembler.add("peer", fragments[0][:fragmentHeaderSize], time.Now())
+		assert.Error(t, err)
+		bad := bytes.Clone(fragments[0])
+		bad[5], bad[6] = 0xff, 0xff
+		_, err = reassembler.add("peer", bad, time.Now())
+		assert.Error(t, err)
+	})
+}
+
+func TestLargeValuesOverUDP(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		config := DefaultConfig()
+		config.Codec = BinaryCodecName
+		config.Encrypt = encrypt
+		config.RPCTimeout = time.Second
+		port := 8231
+		if encrypt {
+			port = 8233
+		}
+		nodeA, err := NewKademliaNode("127.0.0.1", port, config)
+		require.NoError(t, err)
+		defer nodeA.Close()
+		nodeB, err := NewKademliaNode("127.0.0.1", port+1, config)
+		require.NoError(t, err)
+		defer nodeB.Close()
+
+		require.NoError(t, nodeA.SendPing(&nodeB.Self))
+		ctx := context.Background()
+		value := strings.Repeat("large value ", 8000)
+		key := KademliaID(sha1.Sum([]byte(value)))
+		require.NoError(t, nodeA.StoreContext(ctx, &nodeB.Self, value, key.String()))
+
+		_, found, err := nodeA.FindValueContext(ctx, &nodeB.Self, &key)
+		require.NoError(t, err)
+		require.NotNil(t, found, "Value larger than the old read buffer should be found, encrypted: %v", encrypt)
+		assert.Equal(t, value, *found)
+	}
+}
+
+// TestLargeValuesBetweenLookedUpPeers checks that large messages are sent in fragments
+// to peers that were only found through lookups, and never pinged
+func TestLargeValuesBetweenLookedUpPeers(t *testing.T) {
+	config := DefaultConfig()
+	config.Codec = BinaryCodecName
+	nodes := joinedUDPNodes(t, config, 8247, 3)
+	nodeB, nodeC := nodes[1], nodes[2]
+	contact, ok := nodeB.RoutingTable.GetContact(nodeC.Self.ID)
+	require.True(t, ok, "nodeB should have found nodeC through a lookup")
+
+	ctx := context.Background()
+	value := strings.Repeat("large value ", 8000)
+	key := KademliaID(sha1.Sum([]byte(value)))
+	require.NoError(t, nodeB.StoreContext(ctx, &contact, value, key.String()))
+
+	_, found, err := nodeB.FindValueContext(ctx, &contact, &key)
+	require.NoError(t, err)
+	require.NotNil(t, found, "Values larger than a datagram should be found")
+	assert.Equal(t, value, *found)
+}
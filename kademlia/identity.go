@@ -0,0 +1,179 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const nodeKeyFile = "node_key"
+
+// IDFromPublicKey returns the KademliaID of a node owning the public key,
+// the SHA-1 hash of the key
+func IDFromPublicKey(publicKey ed25519.PublicKey) *KademliaID {
+	id := KademliaID(sha1.Sum(publicKey))
+	return &id
+}
+
+// newNodeIdentity returns the ID of the node and the private key it signs its messages
+// with. The ID is derived from the key when the config asks for a verifiable ID.
+// Both are reloaded from the data directory if a previous run saved them
+func newNodeIdentity(config Config) (*KademliaID, ed25519.PrivateKey, error) {
+	privateKey, err := loadOrCreateKey(config.DataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.VerifiableID {
+		return IDFromPublicKey(privateKey.Public().(ed25519.PublicKey)), privateKey, nil
+	}
+
+	id, err := loadOrCreateNodeID(config.DataDir)
+	return id, privateKey, err
+}
+
+// nodeKeyPerm lets only the owner of the node read its key
+const nodeKeyPerm = 0o600
+
+// loadOrCreateKey returns the ed25519 private key saved in the data directory.
+// If there is none, a new key is generated and saved
+func loadOrCreateKey(dataDir string) (ed25519.PrivateKey, error) {
+	if dataDir != "" {
+		path := filepath.Join(dataDir, nodeKeyFile)
+		data, err := os.ReadFile(path)
+		if err == nil {
+			seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("invalid node key in %s", path)
+			}
+			// Keys saved by older builds could be read by anyone
+			if err := os.Chmod(path, nodeKeyPerm); err != nil {
+				return nil, err
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataDir != "" {
+		seed := hex.EncodeToString(privateKey.Seed()) + "\n"
+		if err := writeFileAtomic(filepath.Join(dataDir, nodeKeyFile), []byte(seed), nodeKeyPerm); err != nil {
+			return nil, err
+		}
+	}
+	return privateKey, nil
+}
+
+// publicKey returns the public key of the node, or nil if it has no key
+func (kademlia *Kademlia) publicKey() []byte {
+	if kademlia.privateKey == nil {
+		return nil
+	}
+	return kademlia.privateKey.Public().(ed25519.PublicKey)
+}
+
+// sign attaches the public key of the node to the message and signs it
+func (kademlia *Kademlia) sign(msg *Message) {
+	msg.PublicKey = kademlia.publicKey()
+	msg.Signature = nil
+	if kademlia.privateKey != nil {
+		msg.Signature = ed25519.Sign(kademlia.privateKey, signedBytes(msg))
+	}
+}
+
+// signedBytes returns the bytes a message signature covers: the binary encoding of
+// the message without its signature, which only depends on the fields that are sent
+func signedBytes(msg *Message) []byte {
+	unsigned := *msg
+	unsigned.Signature = nil
+	data, err := BinaryCodec{}.Encode(&unsigned)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// verifySender returns false if the message is not signed by the public key it carries,
+// or if the key does not match the ID of the sender, see acceptKey. Messages without a key,
+// from older peers, are only accepted if keys are not required and the sender ID was never
+// seen with the key it is the hash of.
+//
+// Unless keys are required this is best-effort for the IDs that are not the hash of a key:
+// anyone may sign messages claiming them, or send them unsigned
+func (kademlia *Kademlia) verifySender(msg Message) bool {
+	if msg.From.ID == nil {
+		return false
+	}
+	if len(msg.PublicKey) == 0 {
+		_, cached := kademlia.verifiedKeys.get(msg.From.ID)
+		return !kademlia.Config.RequireKeys && !cached
+	}
+	if len(msg.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	if !ed25519.Verify(msg.PublicKey, signedBytes(&msg), msg.Signature) {
+		return false
+	}
+	return kademlia.acceptKey(msg.From.ID, msg.PublicKey)
+}
+
+// acceptKey returns true if the contact ID may own the public key, whose signature was
+// verified. A key the ID is the hash of is remembered, the ID is then only accepted with
+// that key. Other keys are only accepted if keys are not required, and never remembered
+// so that whoever claims an ID first cannot lock its owner out
+func (kademlia *Kademlia) acceptKey(id *KademliaID, publicKey ed25519.PublicKey) bool {
+	if known, cached := kademlia.verifiedKeys.get(id); cached {
+		return bytes.Equal(known, publicKey)
+	}
+	if !IDFromPublicKey(publicKey).Equals(id) {
+		return !kademlia.Config.RequireKeys
+	}
+	kademlia.verifiedKeys.put(id, publicKey)
+	return true
+}
+
+// maxVerifiedKeys bounds the keys remembered by a keyCache
+const maxVerifiedKeys = 10000
+
+// keyCache remembers the public keys that contact IDs are the hash of
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[KademliaID]ed25519.PublicKey
+}
+
+func (cache *keyCache) get(id *KademliaID) (ed25519.PublicKey, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	key, ok := cache.keys[*id]
+	return key, ok
+}
+
+// put remembers the key of the contact, forgetting another contact if the cache is full
+func (cache *keyCache) put(id *KademliaID, key ed25519.PublicKey) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.keys == nil {
+		cache.keys = make(map[KademliaID]ed25519.PublicKey)
+	}
+	if len(cache.keys) >= maxVerifiedKeys {
+		for other := range cache.keys {
+			delete(cache.keys, other)
+			break
+		}
+	}
+	cache.keys[*id] = bytes.Clone(key)
+}
@@ -0,0 +1,135 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifiableID(t *testing.T) {
+	t.Run("ID is the hash of the public key", func(t *testing.T) {
+		config := DefaultConfig()
+		config.VerifiableID = true
+		id, privateKey, err := newNodeIdentity(config)
+		require.NoError(t, err)
+		require.NotNil(t, privateKey)
+
+		assert.True(t, id.Equals(IDFromPublicKey(privateKey.Public().(ed25519.PublicKey))))
+	})
+
+	t.Run("Key is kept across restarts", func(t *testing.T) {
+		config := DefaultConfig()
+		config.VerifiableID = true
+		config.DataDir = t.TempDir()
+
+		first, _, err := newNodeIdentity(config)
+		require.NoError(t, err)
+		second, _, err := newNodeIdentity(config)
+		require.NoError(t, err)
+
+		assert.True(t, first.Equals(second))
+	})
+
+	t.Run("Key is only readable by its owner", func(t *testing.T) {
+		dataDir := t.TempDir()
+		path := filepath.Join(dataDir, nodeKeyFile)
+		_, err := loadOrCreateKey(dataDir)
+		require.NoError(t, err)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		require.NoError(t, os.Chmod(path, 0o644))
+		_, err = loadOrCreateKey(dataDir)
+		require.NoError(t, err)
+		info, err = os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "Keys saved readable by anyone should be fixed")
+	})
+}
+
+func TestVerifySender(t *testing.T) {
+	config := DefaultConfig()
+	config.VerifiableID = true
+
+	sim := NewSimulatedNetwork()
+	nodeA := NewTestKademliaNode("nodeA", sim, config)
+	nodeB := NewTestKademliaNode("nodeB", sim, config)
+
+	t.Run("Signed message with matching key is accepted", func(t *testing.T) {
+		msg := NewPingMessage(nodeB.Self, *NewRandomKademliaID(), nodeA.Self)
+		nodeB.sign(msg)
+
+		assert.True(t, nodeA.verifySender(*msg))
+	})
+
+	t.Run("Message with a bad signature is dropped", func(t *testing.T) {
+		msg := NewStoreMessage(nodeB.Self, *NewRandomKademliaID(), nodeA.Self, "value")
+		nodeB.sign(msg)
+		msg.Payload = NewStoreMessage(nodeB.Self, msg.RPCID, nodeA.Self, "forged").Payload
+
+		assert.False(t, nodeA.verifySender(*msg), "Changing a signed message should break the signature")
+		msg.Signature = nil
+		assert.False(t, nodeA.verifySender(*msg), "A key without a signature should be dropped")
+	})
+
+	t.Run("Keys are pinned to the ID that is their hash", func(t *testing.T) {
+		other := NewTestKademliaNode("other", sim, DefaultConfig())
+		msg := NewPingMessage(nodeB.Self, *NewRandomKademliaID(), nodeA.Self)
+		other.sign(msg)
+
+		assert.False(t, nodeA.verifySender(*msg), "Another key for a known ID should be dropped")
+
+		unsigned := NewPingMessage(nodeB.Self, *NewRandomKademliaID(), nodeA.Self)
+		assert.False(t, nodeA.verifySender(*unsigned), "Unsigned messages from a known signer should be dropped")
+	})
+
+	t.Run("First key seen for an ID does not lock out its owner", func(t *testing.T) {
+		owner := NewTestKademliaNode("owner", sim, config)
+		attacker := NewTestKademliaNode("attacker", sim, DefaultConfig())
+		forged := NewPingMessage(owner.Self, *NewRandomKademliaID(), nodeA.Self)
+		attacker.sign(forged)
+
+		assert.True(t, nodeA.verifySender(*forged), "Keys that are not the hash of the ID are accepted best-effort")
+		msg := NewPingMessage(owner.Self, *NewRandomKademliaID(), nodeA.Self)
+		owner.sign(msg)
+		assert.True(t, nodeA.verifySender(*msg), "The owner of the ID should still be accepted")
+		assert.False(t, nodeA.verifySender(*forged), "Other keys should be dropped once the owner was seen")
+	})
+
+	t.Run("Message claiming another ID is dropped", func(t *testing.T) {
+		impostor := NewContact(NewRandomKademliaID(), "nodeB")
+		msg := NewPingMessage(impostor, *NewRandomKademliaID(), nodeA.Self)
+		msg.PublicKey = nodeB.publicKey()
+
+		assert.False(t, nodeA.verifySender(*msg))
+
+		nodeA.HandleMessage(*msg, nil)
+		assert.Empty(t, nodeA.RoutingTable.FindClosestContacts(impostor.ID, 1), "Impostor should not enter the routing table")
+	})
+
+	t.Run("Keys can be required", func(t *testing.T) {
+		strict := config
+		strict.RequireKeys = true
+		nodeC := NewTestKademliaNode("nodeC", sim, strict)
+		plain := NewTestKademliaNode("plain", sim, Config{RPCTimeout: 100 * time.Millisecond})
+
+		assert.Error(t, plain.SendPing(&Contact{ID: nodeC.Self.ID, Address: nodeC.Self.Address}),
+			"Ping without a key should be ignored")
+		assert.NoError(t, nodeB.SendPing(&nodeC.Self), "Ping with a matching key should be answered")
+	})
+}
+
+func TestRandomIDsAreUnique(t *testing.T) {
+	seen := make(map[KademliaID]bool)
+	for i := 0; i < 10000; i++ {
+		id := *NewRandomKademliaID()
+		require.False(t, seen[id], "Random IDs should never repeat")
+		seen[id] = true
+	}
+}
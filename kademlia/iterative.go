@@ -1,261 +1,263 @@
 package kademlia
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 )
 
 func (kademlia *Kademlia) LookupNode(target string) []Contact {
 	targetId := NewKademliaID(target)
-	return kademlia.IterativeFindNode(targetId, 3, 20)
+	return kademlia.IterativeFindNode(targetId, kademlia.Config.Alpha, kademlia.Config.K)
 }
 
-func (kademlia *Kademlia) LookupValue(target string) ([]Contact, *string) {
-	targetId := NewKademliaID(target)
-	// TODO if the value exists in the local datastore should we return it directly?
-	// dataItem, exists := kademlia.DataStore.Get(targetId.String())
-	// if exists {
-	// 	return nil, &dataItem
-	// }
-	return kademlia.IterativeFindValue(targetId, 3, 20)
+// ErrValueNotFound is returned when none of the closest contacts to a key has its value
+var ErrValueNotFound = errors.New("value not found")
+
+// ValueResult is the outcome of a value lookup
+type ValueResult struct {
+	Value    *string   // The value, nil if it was not found
+	Source   *Contact  // The contact that returned the value
+	Hops     int       // Number of queries on the way from our routing table to the source
+	LocalHit bool      // The value was found in our own datastore, without any query
+	Contacts []Contact // The k closest contacts to the key, if the value was not found
 }
 
-func (kademlia *Kademlia) IterativeFindValue(target *KademliaID, alpha int, kSize int) ([]Contact, *string) {
-	candidates := &ContactCandidates{}
-	shortlist := kademlia.RoutingTable.FindClosestContacts(target, alpha)
-	candidates.Append(shortlist)
-	queried := make(map[string]bool)
+func (kademlia *Kademlia) LookupValue(target string) (ValueResult, error) {
+	return kademlia.LookupValueContext(kademlia.ctx, target)
+}
 
-	var nodeWithoutValue *Contact = nil
+// LookupValueContext returns the value stored under the target from the local datastore if this
+// node holds it, or else looks it up with the alpha and k of the config.
+// Concurrent calls for the same target share a single lookup, unless the context records a trace.
+// It returns ErrValueNotFound if none of the closest contacts has the value
+func (kademlia *Kademlia) LookupValueContext(ctx context.Context, target string) (ValueResult, error) {
+	key := NewKademliaID(target).String()
+	if traceFromContext(ctx) != nil {
+		return kademlia.lookupValue(ctx, key)
+	}
+	return kademlia.sharedLookupValue(ctx, key)
+}
 
-	for {
-		nodesToQuery := candidates.pickAlpha(queried, alpha)
+func (kademlia *Kademlia) lookupValue(ctx context.Context, target string) (ValueResult, error) {
+	targetId := NewKademliaID(target)
+	if value, exists := kademlia.DataStore.Get(targetId.String()); exists && valueMatchesKey(value, targetId) {
+		traceFromContext(ctx).localHit(targetId)
+		return ValueResult{Value: &value, Source: &kademlia.Self, LocalHit: true}, nil
+	}
 
-		if len(nodesToQuery) == 0 {
-			break
-		}
+	result, err := kademlia.IterativeFindValueContext(ctx, targetId, kademlia.Config.Alpha, kademlia.Config.K)
+	if err == nil && result.Value == nil {
+		err = ErrValueNotFound
+	}
+	return result, err
+}
 
-		type findValueResponse struct {
-			from     *Contact
-			contacts []Contact
-			value    *string
-		}
+func (kademlia *Kademlia) IterativeFindValue(target *KademliaID, alpha int, kSize int) ValueResult {
+	result, _ := kademlia.IterativeFindValueContext(kademlia.ctx, target, alpha, kSize)
+	return result
+}
 
-		responseChan := make(chan findValueResponse, len(nodesToQuery))
-		nbAwaitedAnswer := len(nodesToQuery)
-		for _, c := range nodesToQuery {
-			queried[c.ID.String()] = true
-			if kademlia.Self.ID.Equals(c.ID) {
-				nbAwaitedAnswer--
-				continue
-			}
-			go func(contact Contact) {
-				// Use the FindValue RPC instead of FindNode
-				contacts, found, val := kademlia.FindValue(&contact, target)
-				if found {
-					responseChan <- findValueResponse{from: &contact, contacts: nil, value: val}
-				} else {
-					responseChan <- findValueResponse{from: &contact, contacts: contacts, value: nil}
-				}
-			}(c)
+// IterativeFindValueContext looks up the value stored under the target. It returns the value and
+// the contact it came from, or the k closest contacts to the target if none of them has it. If the
+// context is done before the end of the lookup its error is returned with the closest contacts so far
+func (kademlia *Kademlia) IterativeFindValueContext(ctx context.Context, target *KademliaID, alpha int, kSize int) (ValueResult, error) {
+	strategy := &findValueStrategy{kademlia: kademlia, target: target}
+	result, err := kademlia.Lookup(ctx, target, alpha, kSize, strategy)
+
+	if strategy.value != nil {
+		// Cache the value at the closest node that did not have it, without waiting.
+		// FindValueContext already checked that the value matches the target
+		if node := strategy.closestWithoutValue; node != nil {
+			seen := append(append([]Contact{}, result.Contacts...), result.Answered...)
+			ttl := cacheTTL(kademlia.Config.TTL, nodesBetween(target, node, kSize, seen))
+			go kademlia.CacheContext(kademlia.ctx, node, *strategy.value, ttl)
 		}
 
-		var roundResponses []findValueResponse
-		for i := 0; i < nbAwaitedAnswer; i++ {
-			roundResponses = append(roundResponses, <-responseChan)
-		}
+		return ValueResult{Value: strategy.value, Source: strategy.source, Hops: strategy.hops}, nil
+	}
+	return ValueResult{Contacts: result.Contacts}, err
+}
 
-		progress := false
-		var valueFound *string = nil
-
-		for _, resp := range roundResponses {
-			if resp.value != nil {
-				valueFound = resp.value
-			} else {
-				// This node did NOT have the value. It's a candidate for caching.
-				resp.from.CalcDistance(target)
-				if nodeWithoutValue == nil || resp.from.Less(nodeWithoutValue) {
-					nodeCopy := *resp.from
-					nodeWithoutValue = &nodeCopy
-				}
+// findValueStrategy asks contacts for the value stored under the target,
+// and stops at the first one returning it
+type findValueStrategy struct {
+	kademlia            *Kademlia
+	target              *KademliaID
+	value               *string
+	source              *Contact // The contact that returned the value
+	hops                int      // The round of the query that returned the value
+	closestWithoutValue *Contact // The closest contact that answered without the value
+}
 
-				// Merge the new contacts from the response.
-				if candidates.mergeAndSort(resp.contacts, target, kSize) {
-					progress = true
-				}
-			}
-		}
+func (strategy *findValueStrategy) Query(ctx context.Context, contact Contact) LookupResponse {
+	contacts, value, err := strategy.kademlia.FindValueContext(ctx, &contact, strategy.target)
+	return LookupResponse{Contacts: contacts, Value: value, Err: err}
+}
 
-		if valueFound != nil {
-			hash := sha1.Sum([]byte(*valueFound))
-			key := hex.EncodeToString(hash[:])
+func (strategy *findValueStrategy) Merge(resp LookupResponse) []Contact {
+	if resp.Value != nil {
+		strategy.value = resp.Value
+		strategy.source = &resp.From
+		strategy.hops = resp.Round
+		return nil
+	}
+	if strategy.closestWithoutValue == nil || resp.From.Less(strategy.closestWithoutValue) {
+		strategy.closestWithoutValue = &resp.From
+	}
+	return resp.Contacts
+}
 
-			// Launch the Store call in a separate goroutine and move on.
-			go func(node *Contact, val string, k string) {
-				if node != nil {
-					kademlia.Store(node, val, k)
-				}
-			}(nodeWithoutValue, *valueFound, key)
+func (strategy *findValueStrategy) Done() bool {
+	return strategy.value != nil
+}
 
-			// The function returns IMMEDIATELY without waiting for the Store to finish.
-			return nil, valueFound
-		}
+// maxCacheHalvings bounds the shift of cacheTTL, a cached copy lives at least TTL/2^maxCacheHalvings
+const maxCacheHalvings = 16
 
-		// If no progress was made, stall and exit.
-		if !progress {
-			break
+// cacheTTL returns how long a node should cache a value when between nodes separate it from
+// the k closest nodes to the key: the TTL is halved for every node in between, so that copies
+// cached far from the key, where lookups rarely pass, expire quickly
+func cacheTTL(ttl time.Duration, between int) time.Duration {
+	return ttl >> uint(min(between, maxCacheHalvings))
+}
+
+// nodesBetween returns how many of the contacts seen during a lookup are closer to
+// the target than node, not counting the k closest ones which should hold the value
+func nodesBetween(target *KademliaID, node *Contact, kSize int, seen []Contact) int {
+	closer := make(map[KademliaID]bool)
+	for _, contact := range seen {
+		contact.CalcDistance(target)
+		if contact.Less(node) {
+			closer[*contact.ID] = true
 		}
 	}
-	if candidates.Len() < kSize {
-		return candidates.GetContacts(candidates.Len()), nil
+	return max(0, len(closer)-kSize)
+}
+
+// StoreResult reports where a value was stored
+type StoreResult struct {
+	Key      string          `json:"key"`
+	Wanted   int             `json:"wanted"` // Number of replicas asked for, k
+	Replicas []ReplicaResult `json:"replicas"`
+}
+
+// ReplicaResult is the outcome of the STORE sent to one contact
+type ReplicaResult struct {
+	ID      string        `json:"id"`
+	Address string        `json:"address"`
+	Stored  bool          `json:"stored"`
+	Latency time.Duration `json:"latency"`
+	Err     string        `json:"error,omitempty"`
+}
+
+// Acknowledged returns the number of contacts that stored the value
+func (result StoreResult) Acknowledged() int {
+	acks := 0
+	for _, replica := range result.Replicas {
+		if replica.Stored {
+			acks++
+		}
 	}
-	return candidates.GetContacts(kSize), nil
+	return acks
 }
 
-func (kademlia *Kademlia) IterativeStore(value string) (string, bool) {
+func (kademlia *Kademlia) IterativeStore(value string) StoreResult {
+	result, _ := kademlia.IterativeStoreContext(kademlia.ctx, value)
+	return result
+}
+
+// IterativeStoreContext stores the value at the k closest nodes to its key, and pins a local
+// copy if the config asks for it. Every contact that does not store the value is replaced by
+// the next closest one, until k contacts stored it or there is no contact left to try
+func (kademlia *Kademlia) IterativeStoreContext(ctx context.Context, value string) (StoreResult, error) {
 	//1. Hash the value to get the key
 	dataToHash := []byte(value)
 	hash := sha1.Sum(dataToHash)
 	key := NewKademliaID(hex.EncodeToString(hash[:]))
+	result := StoreResult{Key: key.String(), Wanted: kademlia.Config.K}
 
-	//2. Find the k closest nodes to the key
-	closest := kademlia.IterativeFindNode(key, 3, 20)
-	// closest := kademlia.IterativeFindNode(key)
-	//3. Send STORE RPCs to those nodes
-	successCount := 0
-	chStore := make(chan bool, len(closest))
-
-	for _, contact := range closest {
-		go func() {
-			chStore <- kademlia.Store(&contact, value, key.String())
-		}()
-	}
-
-	for range len(closest) {
-		if <-chStore {
-			successCount++
-		}
+	// Keep our own copy so that we can read the value back before the STOREs complete
+	if !kademlia.Config.NoLocalCopy {
+		kademlia.DataStore.PutPinned(key.String(), value)
 	}
 
-	// If at least one STORE was successful, consider it a success
-	// and print the number of successful stores
-	// Otherwise, print a failure message
-	if successCount > 0 {
-		fmt.Printf("Successfully stored value on %d nodes\n", successCount)
-	} else {
-		fmt.Println("Failed to store value on any node")
+	//2. Find the k closest nodes to the key. The other contacts that answered
+	// the lookup and the routing table provide the next closest ones
+	lookup, err := kademlia.Lookup(ctx, key, kademlia.Config.Alpha, kademlia.Config.K, &findNodeStrategy{kademlia: kademlia, target: key})
+	if err != nil {
+		return result, err
 	}
-
-	//4. If a node does not respond, find a replacement node and send STORE to it // Optional
-	return key.String(), successCount > 0
-}
-
-func (kademlia *Kademlia) IterativeFindNode(target *KademliaID, alpha int, kSize int) []Contact {
+	spares := 2 * kademlia.Config.K
 	candidates := &ContactCandidates{}
-	shortlist := kademlia.RoutingTable.FindClosestContacts(target, alpha)
-	candidates.Append(shortlist)
-	// closestSoFar := &Contact{}
-	var closestSoFar *Contact = nil
-	queried := make(map[string]bool)
-
-	for {
-		nodesToQuery := candidates.pickAlpha(queried, alpha)
-
-		if len(nodesToQuery) == 0 {
-			break
-		}
-
-		responseChan := make(chan []Contact, len(nodesToQuery))
-		nbAwaitedAnswer := len(nodesToQuery)
-		for _, c := range nodesToQuery {
-			queried[c.ID.String()] = true
-			// contacts, _, _ := kademlia.FindNode(&c, target)
-			if kademlia.Self.ID.Equals(c.ID) {
-				nbAwaitedAnswer--
-				continue
-			}
-
+	candidates.mergeAndSort(lookup.Contacts, key, spares, nil)
+	candidates.mergeAndSort(lookup.Answered, key, spares, nil)
+	candidates.mergeAndSort(kademlia.RoutingTable.FindClosestContacts(key, spares), key, spares, nil)
+	// Peers may return us as one of the closest contacts, our own copy is not a replica
+	candidates.remove(kademlia.Self.ID)
+
+	//3. Send STORE RPCs to those nodes, and to replacements of the ones that failed
+	next := 0
+	for result.Acknowledged() < kademlia.Config.K && next < candidates.Len() && ctx.Err() == nil {
+		batch := candidates.contacts[next:min(next+kademlia.Config.K-result.Acknowledged(), candidates.Len())]
+		next += len(batch)
+
+		chStore := make(chan ReplicaResult, len(batch))
+		for _, contact := range batch {
 			go func(contact Contact) {
-				contacts, _, _ := kademlia.FindNode(&contact, target)
-				responseChan <- contacts
-			}(c)
-		}
-
-		progress := false
-		for i := 0; i < nbAwaitedAnswer; i++ {
-			newContacts := <-responseChan
-			if candidates.mergeAndSort(newContacts, target, kSize) {
-				progress = true
-			}
-		}
-
-		if candidates.Len() > 0 {
-			closestDistance := candidates.contacts[0]
-			if closestSoFar == nil || closestDistance.Less(closestSoFar) {
-				closestSoFar = &closestDistance
-			} else if !progress {
-				break
-			}
+				start := time.Now()
+				err := kademlia.StoreContext(ctx, &contact, value, key.String())
+				replica := ReplicaResult{ID: contact.ID.String(), Address: contact.Address, Stored: err == nil, Latency: time.Since(start)}
+				if err != nil {
+					replica.Err = err.Error()
+				}
+				chStore <- replica
+			}(contact)
 		}
-
-		if !progress {
-			break
+		for range batch {
+			result.Replicas = append(result.Replicas, <-chStore)
 		}
-
 	}
 
-	if candidates.Len() < kSize {
-		return candidates.GetContacts(candidates.Len())
+	if acks := result.Acknowledged(); acks > 0 {
+		fmt.Printf("Successfully stored value on %d nodes\n", acks)
+	} else {
+		fmt.Println("Failed to store value on any node")
 	}
-	return candidates.GetContacts(kSize)
+	return result, ctx.Err()
 }
 
-func (c *ContactCandidates) pickAlpha(queried map[string]bool, alpha int) []Contact {
-	toQuery := []Contact{}
-	for _, contact := range c.contacts {
-		if len(toQuery) >= alpha {
-			break
-		}
-		if !queried[contact.ID.String()] {
-			toQuery = append(toQuery, contact)
-		}
-	}
-	return toQuery
+func (kademlia *Kademlia) IterativeFindNode(target *KademliaID, alpha int, kSize int) []Contact {
+	contacts, _ := kademlia.IterativeFindNodeContext(kademlia.ctx, target, alpha, kSize)
+	return contacts
 }
 
-func (c *ContactCandidates) mergeAndSort(newContacts []Contact, target *KademliaID, kSize int) bool {
-	progress := false
-	for _, nc := range newContacts {
-		nc.CalcDistance(target)
-		if !containsContact(c.contacts, nc) {
-			c.Append([]Contact{nc})
-			progress = true
-		}
-	}
+// IterativeFindNodeContext looks up the k closest contacts to the target. If the context is
+// done before the end of the lookup its error is returned with the closest contacts found so far
+func (kademlia *Kademlia) IterativeFindNodeContext(ctx context.Context, target *KademliaID, alpha int, kSize int) ([]Contact, error) {
+	result, err := kademlia.Lookup(ctx, target, alpha, kSize, &findNodeStrategy{kademlia: kademlia, target: target})
+	return result.Contacts, err
+}
 
-	c.SortWithTarget(target)
+// findNodeStrategy asks contacts for their closest contacts to the target
+// until the k closest contacts answered
+type findNodeStrategy struct {
+	kademlia *Kademlia
+	target   *KademliaID
+}
 
-	if c.Len() > kSize {
-		c.contacts = c.GetContacts(kSize)
-	}
-	return progress
+func (strategy *findNodeStrategy) Query(ctx context.Context, contact Contact) LookupResponse {
+	contacts, err := strategy.kademlia.FindNodeContext(ctx, &contact, strategy.target)
+	return LookupResponse{Contacts: contacts, Err: err}
 }
 
-func (c *ContactCandidates) SortWithTarget(target *KademliaID) {
-	for i := range c.contacts {
-		if c.contacts[i].distance == nil {
-			c.contacts[i].CalcDistance(target)
-		}
-	}
-	c.Sort()
+func (strategy *findNodeStrategy) Merge(resp LookupResponse) []Contact {
+	return resp.Contacts
 }
 
-func containsContact(list []Contact, c Contact) bool {
-	for _, x := range list {
-		if x.ID.Equals(c.ID) {
-			return true
-		}
-	}
+func (strategy *findNodeStrategy) Done() bool {
 	return false
 }
@@ -1,8 +1,14 @@
 package kademlia
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,8 +27,8 @@ func getIDs(contacts []Contact) []string {
 
 // Set up two nodes that know each other
 func setupTwoNodes(sim *SimulatedNetwork, addrA, addrB string) (*Kademlia, *Kademlia) {
-	nodeA := NewTestKademliaNode(addrA, sim)
-	nodeB := NewTestKademliaNode(addrB, sim)
+	nodeA := NewTestKademliaNode(addrA, sim, DefaultConfig())
+	nodeB := NewTestKademliaNode(addrB, sim, DefaultConfig())
 	nodeA.RoutingTable.AddContact(nodeB.Self)
 	nodeB.RoutingTable.AddContact(nodeA.Self)
 	return nodeA, nodeB
@@ -38,7 +44,7 @@ func TestIterativeFindNode(t *testing.T) {
 	t.Run("Neighbors", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
 		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
-		nodeC := NewTestKademliaNode("nodeC", sim)
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
 		nodeA.RoutingTable.AddContact(nodeC.Self)
 
 		target := NewRandomKademliaID()
@@ -51,7 +57,7 @@ func TestIterativeFindNode(t *testing.T) {
 
 	t.Run("Empty routing table", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
-		node := NewTestKademliaNode("nodeX", sim)
+		node := NewTestKademliaNode("nodeX", sim, DefaultConfig())
 
 		target := NewRandomKademliaID()
 		result := node.IterativeFindNode(target, 3, 20)
@@ -62,10 +68,10 @@ func TestIterativeFindNode(t *testing.T) {
 	t.Run("Multi-hop discovery", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
 
-		nodeA := NewTestKademliaNode("nodeA", sim)
-		nodeB := NewTestKademliaNode("nodeB", sim)
-		nodeC := NewTestKademliaNode("nodeC", sim)
-		nodeD := NewTestKademliaNode("nodeD", sim)
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
+		nodeB := NewTestKademliaNode("nodeB", sim, DefaultConfig())
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
+		nodeD := NewTestKademliaNode("nodeD", sim, DefaultConfig())
 
 		// A → B → C → D
 		nodeA.RoutingTable.AddContact(nodeB.Self)
@@ -83,7 +89,7 @@ func TestIterativeFindNode(t *testing.T) {
 		target := NewRandomKademliaID()
 
 		nodeA, _ := setupTwoNodes(sim, "nodeA", "nodeB")
-		nodeC := NewTestKademliaNode("nodeC", sim)
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
 		nodeA.RoutingTable.AddContact(nodeC.Self)
 
 		result := nodeA.IterativeFindNode(target, 3, 20)
@@ -105,10 +111,31 @@ func TestIterativeFindValue(t *testing.T) {
 		key := hashKeyForValue(value)
 		nodeB.DataStore.Put(key.String(), value)
 
-		_, found := nodeA.IterativeFindValue(key, 3, 20)
+		result := nodeA.IterativeFindValue(key, 3, 20)
 
-		require.NotNil(t, found, "Value should not be nil")
-		assert.Equal(t, value, *found)
+		require.NotNil(t, result.Value, "Value should not be nil")
+		assert.Equal(t, value, *result.Value)
+		require.NotNil(t, result.Source, "Source should be returned with the value")
+		assert.Equal(t, nodeB.Self.ID.String(), result.Source.ID.String())
+		assert.Equal(t, 1, result.Hops)
+	})
+
+	t.Run("Source and hops of a value found further away", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
+		nodeB.RoutingTable.AddContact(nodeC.Self)
+
+		value := "twoHopsAway"
+		key := hashKeyForValue(value)
+		nodeC.DataStore.Put(key.String(), value)
+
+		result, err := nodeA.LookupValue(key.String())
+
+		require.NoError(t, err)
+		require.NotNil(t, result.Source)
+		assert.Equal(t, "nodeC", result.Source.Address)
+		assert.Equal(t, 2, result.Hops)
 	})
 
 	t.Run("Not found returns contacts", func(t *testing.T) {
@@ -116,17 +143,45 @@ func TestIterativeFindValue(t *testing.T) {
 		nodeA, _ := setupTwoNodes(sim, "nodeA", "nodeB")
 
 		target := NewRandomKademliaID()
-		contacts, found := nodeA.IterativeFindValue(target, 3, 20)
+		result := nodeA.IterativeFindValue(target, 3, 20)
+
+		assert.Nil(t, result.Value)
+		assert.Nil(t, result.Source)
+		assert.NotEmpty(t, result.Contacts)
+
+		_, err := nodeA.LookupValue(target.String())
+		assert.ErrorIs(t, err, ErrValueNotFound)
+	})
+
+	t.Run("Wrong values are discarded and their source penalised", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
+		liar := NewTestKademliaNode("liar", sim, DefaultConfig())
+		honest := NewTestKademliaNode("honest", sim, DefaultConfig())
+		nodeA.RoutingTable.AddContact(liar.Self)
+		nodeA.RoutingTable.AddContact(honest.Self)
+		// The honest node answers after the liar
+		sim.SetDelay("honest", 50*time.Millisecond)
+
+		value := "genuineValue"
+		key := hashKeyForValue(value)
+		liar.DataStore.Put(key.String(), "forgedValue")
+		honest.DataStore.Put(key.String(), value)
+
+		result := nodeA.IterativeFindValue(key, 3, 20)
 
-		assert.Nil(t, found)
-		assert.NotEmpty(t, contacts)
+		require.NotNil(t, result.Value)
+		assert.Equal(t, value, *result.Value)
+		assert.Equal(t, "honest", result.Source.Address)
+		assert.NotContains(t, getIDs(nodeA.RoutingTable.AllContacts()), liar.Self.ID.String(),
+			"The liar should be removed from the routing table")
 	})
 
 	t.Run("Caches value in closest node without value", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
-		nodeA := NewTestKademliaNode("nodeA", sim)
-		nodeB := NewTestKademliaNode("nodeB", sim)
-		nodeC := NewTestKademliaNode("nodeC", sim)
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
+		nodeB := NewTestKademliaNode("nodeB", sim, DefaultConfig())
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
 
 		value := "closestGetsValue"
 		key := hashKeyForValue(value)
@@ -143,44 +198,152 @@ func TestIterativeFindValue(t *testing.T) {
 			return stored == value
 		}, time.Second, 50*time.Millisecond,
 			"NodeB should eventually cache the value")
+		assert.True(t, nodeB.DataStore.IsCached(key.String()), "NodeB should hold a cached copy, not a replica")
+		assert.False(t, nodeC.DataStore.IsCached(key.String()))
 	})
 
 }
 
+func TestCacheTTL(t *testing.T) {
+	assert.Equal(t, time.Hour, cacheTTL(time.Hour, 0))
+	assert.Equal(t, 30*time.Minute, cacheTTL(time.Hour, 1))
+	assert.Equal(t, 15*time.Minute, cacheTTL(time.Hour, 2))
+	assert.Equal(t, cacheTTL(time.Hour, maxCacheHalvings), cacheTTL(time.Hour, 1000))
+
+	target := NewKademliaID("0000000000000000000000000000000000000000")
+	var contacts []Contact
+	for i := 1; i <= 5; i++ {
+		contacts = append(contacts, NewContact(NewKademliaID(fmt.Sprintf("%040x", i)), "node"))
+	}
+	node := contacts[4]
+	node.CalcDistance(target)
+	seen := append(contacts[:3:3], contacts[2:]...)
+	assert.Equal(t, 2, nodesBetween(target, &node, 2, seen), "4 contacts are closer than the node, 2 of them are the k closest")
+	assert.Equal(t, 0, nodesBetween(target, &node, 20, seen))
+}
+
+func TestStorePayload(t *testing.T) {
+	t.Run("Primary replicas are sent as the value alone", func(t *testing.T) {
+		msg := NewStoreMessage(NewContact(NewRandomKademliaID(), "a"), *NewRandomKademliaID(), NewContact(NewRandomKademliaID(), "b"), "value")
+		var value string
+		require.NoError(t, json.Unmarshal(msg.Payload, &value), "Older peers only decode a string")
+		assert.Equal(t, "value", value)
+	})
+
+	t.Run("Cached copies are only asked to peers that keep them apart", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		older := NewTestKademliaNode("older", sim, DefaultConfig())
+		ctx := context.Background()
+
+		err := nodeA.CacheContext(ctx, &Contact{ID: older.Self.ID, Address: older.Self.Address}, "value", time.Hour)
+		assert.ErrorIs(t, err, ErrCacheNotSupported)
+		_, stored := older.DataStore.Get(hashKeyForValue("value").String())
+		assert.False(t, stored)
+
+		require.NoError(t, nodeA.CacheContext(ctx, &Contact{ID: nodeB.Self.ID, Address: nodeB.Self.Address}, "value", time.Hour),
+			"Capabilities of the contacts of the routing table should be used")
+	})
+}
+
+// TestPathCachingOverUDP checks that a value found by a lookup is cached at the closest
+// node without it, which the node looking up only knows through a lookup
+func TestPathCachingOverUDP(t *testing.T) {
+	config := DefaultConfig()
+	config.Alpha = 1
+	nodes := joinedUDPNodes(t, config, 8244, 3)
+	bootstrap, nodeB, nodeC := nodes[0], nodes[1], nodes[2]
+
+	// nodeC asks nodeB first, which does not have the value
+	value := "cached value"
+	for i := 0; hashKeyForValue(value).CalcDistance(bootstrap.Self.ID).Less(hashKeyForValue(value).CalcDistance(nodeB.Self.ID)); i++ {
+		value = fmt.Sprintf("cached value %d", i)
+	}
+	key := hashKeyForValue(value)
+	ctx := context.Background()
+	require.NoError(t, nodeC.StoreContext(ctx, &bootstrap.Self, value, key.String()))
+
+	result, err := nodeC.IterativeFindValueContext(ctx, key, config.Alpha, config.K)
+	require.NoError(t, err)
+	require.NotNil(t, result.Value)
+
+	deadline := time.Now().Add(time.Second)
+	for !nodeB.DataStore.IsCached(key.String()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, nodeB.DataStore.IsCached(key.String()), "nodeB should keep a cached copy of the value")
+}
+
 func TestIterativeStore(t *testing.T) {
 	t.Run("Stores on one neighbor", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
 		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
 
 		value := "storeMe"
-		key, success := nodeA.IterativeStore(value)
+		result := nodeA.IterativeStore(value)
 
-		assert.True(t, success, "Store should succeed")
-		stored, _ := nodeB.DataStore.Get(key)
+		assert.Equal(t, 1, result.Acknowledged(), "Store should succeed")
+		require.Len(t, result.Replicas, 1)
+		assert.Equal(t, "nodeB", result.Replicas[0].Address)
+		assert.True(t, result.Replicas[0].Stored)
+		stored, _ := nodeB.DataStore.Get(result.Key)
 		assert.Equal(t, value, stored)
 	})
 
+	t.Run("Value can be read back at once", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.RPCTimeout = 20 * time.Millisecond
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		nodeB := NewTestKademliaNode("nodeB", sim, config)
+		nodeA.RoutingTable.AddContact(nodeB.Self)
+		// The STORE never reaches nodeB
+		sim.SetDropRate(1)
+
+		key := nodeA.IterativeStore("readYourWrites").Key
+		result, err := nodeA.LookupValue(key)
+
+		require.NoError(t, err)
+		assert.Equal(t, "readYourWrites", *result.Value)
+		assert.True(t, result.LocalHit, "Value should come from the local store")
+		assert.Equal(t, nodeA.Self.ID.String(), result.Source.ID.String())
+	})
+
+	t.Run("No local copy unless asked for", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.NoLocalCopy = true
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+
+		key := nodeA.IterativeStore("notPinned").Key
+
+		_, exists := nodeA.DataStore.Get(key)
+		assert.False(t, exists)
+	})
+
 	t.Run("No nodes available", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
-		nodeA := NewTestKademliaNode("nodeA", sim)
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
 
-		_, success := nodeA.IterativeStore("nothingHappens")
-		assert.False(t, success, "Store should fail when no nodes are available")
+		result := nodeA.IterativeStore("nothingHappens")
+		assert.Zero(t, result.Acknowledged(), "Store should fail when no nodes are available")
+		assert.Empty(t, result.Replicas)
 	})
 
 	t.Run("Stores on multiple nodes", func(t *testing.T) {
 		sim := NewSimulatedNetwork()
-		nodeA := NewTestKademliaNode("nodeA", sim)
-		nodeB := NewTestKademliaNode("nodeB", sim)
-		nodeC := NewTestKademliaNode("nodeC", sim)
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
+		nodeB := NewTestKademliaNode("nodeB", sim, DefaultConfig())
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
 
 		nodeA.RoutingTable.AddContact(nodeB.Self)
 		nodeA.RoutingTable.AddContact(nodeC.Self)
 
 		value := "spreadThis"
-		key, success := nodeA.IterativeStore(value)
+		result := nodeA.IterativeStore(value)
+		key := result.Key
 
-		assert.True(t, success, "Store should succeed with multiple nodes")
+		assert.Equal(t, 2, result.Acknowledged(), "Store should succeed with multiple nodes")
 
 		storedB, _ := nodeB.DataStore.Get(key)
 		storedC, _ := nodeC.DataStore.Get(key)
@@ -190,6 +353,444 @@ func TestIterativeStore(t *testing.T) {
 	})
 }
 
+func TestStoreReplacesFailedReplicas(t *testing.T) {
+	sim := NewSimulatedNetwork()
+	config := DefaultConfig()
+	config.K = 2
+	value := "replaceDeadReplicas"
+	key := hashKeyForValue(value)
+
+	// The dead node is the closest to the key, then nodeB and nodeC. nodeA has the key as
+	// ID so that they fall in buckets with room for them, and the dead node is not
+	// evicted by a ping when nodeC gets known before the STOREs are sent
+	nodeA := nodeWithID(t, sim, "nodeA", key, config)
+	dead := nodeWithID(t, sim, "dead", idNear(key, 1), config)
+	nodeB := nodeWithID(t, sim, "nodeB", idNear(key, 2), config)
+	nodeC := nodeWithID(t, sim, "nodeC", idNear(key, 3), config)
+	nodeA.RoutingTable.AddContact(dead.Self)
+	nodeA.RoutingTable.AddContact(nodeB.Self)
+	nodeB.RoutingTable.AddContact(nodeC.Self)
+	dead.Close()
+
+	result := nodeA.IterativeStore(value)
+
+	assert.Equal(t, 2, result.Acknowledged())
+	require.Len(t, result.Replicas, 3, "The dead node should be replaced by the next closest one")
+	stored := make(map[string]bool)
+	for _, replica := range result.Replicas {
+		stored[replica.Address] = replica.Stored
+	}
+	assert.Equal(t, map[string]bool{"dead": false, "nodeB": true, "nodeC": true}, stored)
+	value, _ = nodeC.DataStore.Get(key.String())
+	assert.Equal(t, "replaceDeadReplicas", value)
+}
+
+// idNear returns the ID whose distance to the id is the given small number
+func idNear(id *KademliaID, distance byte) *KademliaID {
+	near := *id
+	near[IDLength-1] ^= distance
+	return &near
+}
+
+// nodeWithID creates a test node with the given ID, saved in its data directory
+func nodeWithID(t *testing.T, sim *SimulatedNetwork, address string, id *KademliaID, config Config) *Kademlia {
+	config.DataDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(config.DataDir, nodeIDFile), []byte(id.String()), 0o644))
+	return NewTestKademliaNode(address, sim, config)
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("Lookups return at most k contacts", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.K = 4
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		for i := 0; i < 10; i++ {
+			node := NewTestKademliaNode(fmt.Sprintf("node%d", i), sim, config)
+			nodeA.RoutingTable.AddContact(node.Self)
+		}
+
+		result := nodeA.LookupNode(NewRandomKademliaID().String())
+
+		assert.Len(t, result, 4, "Lookup should return k contacts")
+	})
+
+	t.Run("Unset parameters get their default value", func(t *testing.T) {
+		config := Config{K: 4}.withDefaults()
+
+		assert.Equal(t, 4, config.K)
+		assert.Equal(t, DefaultConfig().Alpha, config.Alpha)
+		assert.Equal(t, DefaultConfig().RPCTimeout, config.RPCTimeout)
+		assert.False(t, config.NoLocalCopy, "A local copy should be kept by default")
+	})
+}
+
+func TestUnresponsiveContacts(t *testing.T) {
+	t.Run("Lookup drops dead nodes from its result", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		dead := NewTestKademliaNode("dead", sim, DefaultConfig())
+		nodeA.RoutingTable.AddContact(dead.Self)
+		dead.Close()
+
+		result := nodeA.IterativeFindNode(NewRandomKademliaID(), 3, 20)
+
+		ids := getIDs(result)
+		assert.Contains(t, ids, nodeB.Self.ID.String())
+		assert.NotContains(t, ids, dead.Self.ID.String(), "Dead node should be dropped from the shortlist")
+	})
+
+	t.Run("Timed out contacts are evicted after MaxFailures", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.RPCTimeout = 20 * time.Millisecond
+		config.MaxFailures = 2
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		nodeB := NewTestKademliaNode("nodeB", sim, config)
+		nodeA.RoutingTable.AddContact(nodeB.Self)
+		sim.SetDropRate(1)
+
+		nodeA.FindNode(&nodeB.Self, NewRandomKademliaID())
+		assert.Len(t, nodeA.RoutingTable.FindClosestContacts(nodeB.Self.ID, 1), 1, "One timeout should not evict")
+
+		nodeA.FindNode(&nodeB.Self, NewRandomKademliaID())
+		assert.Empty(t, nodeA.RoutingTable.FindClosestContacts(nodeB.Self.ID, 1), "Contact should be evicted after two timeouts")
+	})
+}
+
+func TestLookupTermination(t *testing.T) {
+	t.Run("Final round queries every unqueried contact of the k closest", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		target := NewTestKademliaNode("target", sim, DefaultConfig())
+
+		var middle []*Kademlia
+		for i := 0; i < 4; i++ {
+			node := NewTestKademliaNode(fmt.Sprintf("middle%d", i), sim, DefaultConfig())
+			nodeB.RoutingTable.AddContact(node.Self)
+			middle = append(middle, node)
+		}
+		// Only the middle node furthest from the target knows it, so a lookup
+		// querying one contact at a time stalls before reaching it
+		furthest := middle[0]
+		for _, node := range middle[1:] {
+			if furthest.Self.ID.CalcDistance(target.Self.ID).Less(node.Self.ID.CalcDistance(target.Self.ID)) {
+				furthest = node
+			}
+		}
+		furthest.RoutingTable.AddContact(target.Self)
+
+		result := nodeA.IterativeFindNode(target.Self.ID, 1, 20)
+
+		require.NotEmpty(t, result)
+		assert.Equal(t, target.Self.ID.String(), result[0].ID.String(), "Lookup should find the node closest to the target")
+	})
+}
+
+func TestSlowContacts(t *testing.T) {
+	t.Run("Lookup does not wait on a slow contact", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.StaleTimeout = 50 * time.Millisecond
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		nodeB := NewTestKademliaNode("nodeB", sim, config)
+		slow := NewTestKademliaNode("slow", sim, config)
+		nodeA.RoutingTable.AddContact(nodeB.Self)
+		nodeA.RoutingTable.AddContact(slow.Self)
+		sim.SetDelay("slow", time.Second)
+
+		value := "value behind a slow node"
+		key := hashKeyForValue(value)
+		nodeB.DataStore.Put(key.String(), value)
+
+		start := time.Now()
+		result := nodeA.IterativeFindValue(key, 1, 20)
+
+		require.NotNil(t, result.Value)
+		assert.Equal(t, value, *result.Value)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "Lookup should query nodeB while slow is stale")
+	})
+
+	t.Run("Answers of stale contacts are still used", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.StaleTimeout = 10 * time.Millisecond
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		slow := NewTestKademliaNode("slow", sim, config)
+		nodeC := NewTestKademliaNode("nodeC", sim, config)
+		nodeA.RoutingTable.AddContact(slow.Self)
+		slow.RoutingTable.AddContact(nodeC.Self)
+		sim.SetDelay("slow", 100*time.Millisecond)
+
+		result := nodeA.IterativeFindNode(NewRandomKademliaID(), 3, 20)
+
+		ids := getIDs(result)
+		assert.Contains(t, ids, slow.Self.ID.String())
+		assert.Contains(t, ids, nodeC.Self.ID.String(), "Contacts returned by a stale node should be queried")
+	})
+}
+
+func TestContext(t *testing.T) {
+	t.Run("Lookup stops at the deadline of its context", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, _ := setupTwoNodes(sim, "nodeA", "nodeB")
+		sim.SetDelay("nodeB", time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := nodeA.IterativeFindNodeContext(ctx, NewRandomKademliaID(), 3, 20)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "Lookup should not wait for the slow node")
+	})
+
+	t.Run("Canceled RPCs are not counted as failures", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		config := DefaultConfig()
+		config.MaxFailures = 1
+		nodeA := NewTestKademliaNode("nodeA", sim, config)
+		nodeB := NewTestKademliaNode("nodeB", sim, config)
+		nodeA.RoutingTable.AddContact(nodeB.Self)
+		sim.SetDropRate(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := nodeA.SendPingContext(ctx, &nodeB.Self)
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Len(t, nodeA.RoutingTable.FindClosestContacts(nodeB.Self.ID, 1), 1, "Contact should stay in the routing table")
+	})
+
+	t.Run("Closing the node abandons its lookups", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, _ := setupTwoNodes(sim, "nodeA", "nodeB")
+		sim.SetDelay("nodeB", time.Second)
+
+		done := make(chan []Contact)
+		go func() {
+			done <- nodeA.IterativeFindNode(NewRandomKademliaID(), 3, 20)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		nodeA.Close()
+
+		select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("Lookup should end when the node is closed")
+		}
+	})
+}
+
+// addressStrategy is a lookup looking for the node with the given address
+type addressStrategy struct {
+	kademlia *Kademlia
+	address  string
+	found    *LookupResponse
+}
+
+func (strategy *addressStrategy) Query(ctx context.Context, contact Contact) LookupResponse {
+	contacts, err := strategy.kademlia.FindNodeContext(ctx, &contact, NewRandomKademliaID())
+	return LookupResponse{Contacts: contacts, Payload: contact.Address == strategy.address, Err: err}
+}
+
+func (strategy *addressStrategy) Merge(resp LookupResponse) []Contact {
+	if resp.Payload.(bool) {
+		strategy.found = &resp
+	}
+	return resp.Contacts
+}
+
+func (strategy *addressStrategy) Done() bool {
+	return strategy.found != nil
+}
+
+func TestLookupStrategy(t *testing.T) {
+	sim := NewSimulatedNetwork()
+	nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+	nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
+	nodeD := NewTestKademliaNode("nodeD", sim, DefaultConfig())
+	nodeB.RoutingTable.AddContact(nodeC.Self)
+	nodeC.RoutingTable.AddContact(nodeD.Self)
+
+	strategy := &addressStrategy{kademlia: nodeA, address: "nodeC"}
+	ctx, trace := WithLookupTrace(context.Background())
+	result, err := nodeA.Lookup(ctx, nodeD.Self.ID, 1, 20, strategy)
+
+	require.NoError(t, err)
+	require.NotNil(t, strategy.found, "The lookup should reach nodeC")
+	assert.Equal(t, 2, strategy.found.Round)
+	assert.True(t, trace.Found)
+	assert.Len(t, result.Answered, 2)
+	assert.NotContains(t, getIDs(result.Answered), nodeD.Self.ID.String(), "The lookup should stop once the strategy is done")
+}
+
+func TestLookupValues(t *testing.T) {
+	t.Run("Concurrent lookups of a key share one lookup", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		sim.SetDelay("nodeB", 50*time.Millisecond)
+
+		value := "popular"
+		key := hashKeyForValue(value)
+		nodeB.DataStore.Put(key.String(), value)
+
+		results := make([]ValueResult, 5)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], _ = nodeA.LookupValue(key.String())
+			}(i)
+		}
+		wg.Wait()
+
+		for _, result := range results {
+			require.NotNil(t, result.Value)
+			assert.Same(t, results[0].Value, result.Value, "Every caller should get the result of the same lookup")
+		}
+	})
+
+	t.Run("A caller leaving does not cancel the others", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		sim.SetDelay("nodeB", 50*time.Millisecond)
+
+		value := "still wanted"
+		key := hashKeyForValue(value)
+		nodeB.DataStore.Put(key.String(), value)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		left := make(chan error)
+		go func() {
+			_, err := nodeA.LookupValueContext(ctx, key.String())
+			left <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		stayed := make(chan ValueResult)
+		go func() {
+			result, _ := nodeA.LookupValue(key.String())
+			stayed <- result
+		}()
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+
+		assert.ErrorIs(t, <-left, context.Canceled)
+		result := <-stayed
+		require.NotNil(t, result.Value)
+		assert.Equal(t, value, *result.Value)
+	})
+
+	t.Run("Results follow the order of the keys", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
+		nodeB.RoutingTable.AddContact(nodeC.Self)
+
+		first, second := "first", "second"
+		nodeC.DataStore.Put(hashKeyForValue(first).String(), first)
+		nodeB.DataStore.Put(hashKeyForValue(second).String(), second)
+		missing := hashKeyForValue("missing").String()
+
+		results := nodeA.LookupValues([]string{hashKeyForValue(first).String(), missing, hashKeyForValue(second).String()})
+
+		require.Len(t, results, 3)
+		require.NoError(t, results[0].Err)
+		assert.Equal(t, first, *results[0].Value)
+		assert.Equal(t, missing, results[1].Key)
+		assert.ErrorIs(t, results[1].Err, ErrValueNotFound)
+		require.NoError(t, results[2].Err)
+		assert.Equal(t, second, *results[2].Value)
+	})
+
+	t.Run("Lookups of a batch start from the contacts learned by the others", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, nodeB := setupTwoNodes(sim, "nodeA", "nodeB")
+		nodeC := NewTestKademliaNode("nodeC", sim, DefaultConfig())
+		nodeB.RoutingTable.AddContact(nodeC.Self)
+
+		pool := &contactPool{}
+		ctx := withContactPool(context.Background(), pool)
+		_, err := nodeA.IterativeFindNodeContext(ctx, nodeC.Self.ID, 3, 20)
+		require.NoError(t, err)
+		assert.Contains(t, getIDs(pool.closest(nodeC.Self.ID, 20)), nodeC.Self.ID.String())
+
+		// nodeD only knows nodeC through the pool
+		nodeD := NewTestKademliaNode("nodeD", sim, DefaultConfig())
+		value := "near nodeC"
+		key := hashKeyForValue(value)
+		nodeC.DataStore.Put(key.String(), value)
+
+		result, err := nodeD.LookupValueContext(ctx, key.String())
+		require.NoError(t, err)
+		assert.Equal(t, "nodeC", result.Source.Address)
+		assert.Equal(t, 1, result.Hops)
+	})
+
+	t.Run("Lookups of a batch never return the node itself", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA, _ := setupTwoNodes(sim, "nodeA", "nodeB")
+
+		pool := &contactPool{}
+		ctx := withContactPool(context.Background(), pool)
+		_, err := nodeA.IterativeFindNodeContext(ctx, nodeA.Self.ID, 3, 20)
+		require.NoError(t, err)
+		require.Contains(t, getIDs(pool.closest(nodeA.Self.ID, 20)), nodeA.Self.ID.String(),
+			"nodeB returns nodeA to itself")
+
+		traceCtx, trace := WithLookupTrace(ctx)
+		contacts, err := nodeA.IterativeFindNodeContext(traceCtx, nodeA.Self.ID, 3, 20)
+		require.NoError(t, err)
+		assert.NotContains(t, getIDs(contacts), nodeA.Self.ID.String())
+		for _, query := range trace.Queries {
+			assert.NotEqual(t, nodeA.Self.ID.String(), query.ID, "nodeA should not query itself")
+		}
+	})
+}
+
+func TestLookupTrace(t *testing.T) {
+	sim := NewSimulatedNetwork()
+	config := DefaultConfig()
+	config.RPCTimeout = 50 * time.Millisecond
+	nodeA := NewTestKademliaNode("nodeA", sim, config)
+	nodeB := NewTestKademliaNode("nodeB", sim, config)
+	nodeC := NewTestKademliaNode("nodeC", sim, config)
+	slow := NewTestKademliaNode("slow", sim, config)
+	nodeA.RoutingTable.AddContact(nodeB.Self)
+	nodeA.RoutingTable.AddContact(slow.Self)
+	nodeB.RoutingTable.AddContact(nodeC.Self)
+	sim.SetDelay("slow", time.Second)
+
+	ctx, trace := WithLookupTrace(context.Background())
+	_, err := nodeA.IterativeFindNodeContext(ctx, NewRandomKademliaID(), 3, 20)
+	require.NoError(t, err)
+
+	queries := make(map[string]TraceQuery)
+	for _, query := range trace.Queries {
+		queries[query.Address] = query
+	}
+	require.Contains(t, queries, "nodeB")
+	require.Contains(t, queries, "nodeC")
+	require.Contains(t, queries, "slow")
+	assert.Equal(t, 1, queries["nodeB"].Round)
+	assert.Equal(t, 2, queries["nodeC"].Round, "nodeC was returned by a query of round 1")
+	assert.True(t, queries["slow"].TimedOut)
+	assert.False(t, queries["nodeB"].TimedOut)
+	assert.Greater(t, queries["slow"].RTT, queries["nodeB"].RTT)
+
+	returned := make([]string, 0)
+	for _, contact := range queries["nodeB"].Returned {
+		returned = append(returned, contact.Address)
+	}
+	assert.Contains(t, returned, "nodeC")
+
+	require.Len(t, trace.Rounds, 2)
+	assert.NotEmpty(t, trace.Rounds[0].Closest)
+	assert.False(t, trace.Found)
+	assert.Greater(t, trace.Duration, time.Duration(0))
+}
+
 func TestHelpers(t *testing.T) {
 	t.Run("pickAlpha stops at alpha limit", func(t *testing.T) {
 		candidates := &ContactCandidates{}
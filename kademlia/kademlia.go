@@ -1,10 +1,13 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/ed25519"
 	"d7024e/storage"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -19,12 +22,21 @@ type Kademlia struct {
 	RoutingTable *RoutingTable
 	mapManagerCh chan MapRequest
 	DataStore    storage.Storage
+	Config       Config
+	privateKey   ed25519.PrivateKey
+	verifiedKeys keyCache        // Public keys of the peers whose ID is their hash
+	ctx          context.Context // Done when the node is closed
+	stop         context.CancelFunc
+	closeOnce    sync.Once
+	calls        map[string]*valueCall // Value lookups in progress by key
+	callsMu      sync.Mutex
 }
 
 type MapRequest struct {
 	rpcID        KademliaID
 	responseChan chan Message
 	register     bool
+	cancel       bool
 	responseMsg  Message
 }
 
@@ -33,7 +45,15 @@ type DataItem struct {
 	timeToLive time.Time
 }
 
-func NewKademliaNode(ip string, port int) (*Kademlia, error) {
+// NewKademliaNode creates a node listening on the given UDP port,
+// unset parameters of the config are given their default value
+func NewKademliaNode(ip string, port int, config Config) (*Kademlia, error) {
+	config = config.withDefaults()
+	codec, err := CodecByName(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
 	// 1. Resolve the listening address (using "0.0.0.0" is correct here)
 	listenAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", "0.0.0.0", port))
 	if err != nil {
@@ -51,28 +71,46 @@ func NewKademliaNode(ip string, port int) (*Kademlia, error) {
 		outboundIP = "127.0.0.1" // Fallback for local testing
 	}
 
+	// 2. Reuse the node ID of a previous run if there is a data directory
+	id, privateKey, err := newNodeIdentity(config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	// 3. Create the Contact with the CORRECT, public address
 	contact := Contact{
-		ID:       NewRandomKademliaID(),
-		Address:  fmt.Sprintf("%s:%d", outboundIP, port), // Use the discovered IP
-		distance: nil,
+		ID:           id,
+		Address:      fmt.Sprintf("%s:%d", outboundIP, port), // Use the discovered IP
+		Version:      ProtocolVersion,
+		Capabilities: supportedCapabilities,
+		distance:     nil,
 	}
 
-	routingtable := NewRoutingTable(contact)
+	routingtable := NewRoutingTableWithConfig(contact, config)
 
+	ctx, stop := context.WithCancel(context.Background())
 	kademlia := &Kademlia{
 		Self:         contact,
 		RoutingTable: routingtable,
 		mapManagerCh: make(chan MapRequest),
-		DataStore:    *storage.NewStorage(),
+		DataStore:    *storage.NewStorageWithTTL(config.TTL),
+		Config:       config,
+		privateKey:   privateKey,
+		ctx:          ctx,
+		stop:         stop,
 	}
 
-	network := NewNetwork(contact, conn, kademlia.HandleMessage)
+	network := NewNetwork(contact, conn, codec, kademlia.HandleMessage)
+	network.Encrypt = config.Encrypt
+	network.identity = privateKey
+	network.verifyKey = kademlia.acceptKey
 
 	kademlia.Network = network
 
 	go kademlia.Network.Listen()
 	go kademlia.managePendingRequests()
+	go kademlia.maintain()
 
 	return kademlia, nil
 }
@@ -83,6 +121,8 @@ func (k *Kademlia) managePendingRequests() {
 	for req := range k.mapManagerCh {
 		if req.register {
 			pending[req.rpcID.String()] = req.responseChan
+		} else if req.cancel {
+			delete(pending, req.rpcID.String())
 		} else {
 			if ch, ok := pending[req.rpcID.String()]; ok {
 				ch <- req.responseMsg
@@ -92,34 +132,112 @@ func (k *Kademlia) managePendingRequests() {
 	}
 }
 
+// JoinNetwork is JoinNetworkContext with the context of the node
 func (kademlia *Kademlia) JoinNetwork(knownContact *Contact) {
+	if err := kademlia.JoinNetworkContext(kademlia.ctx, knownContact); err != nil {
+		fmt.Println("Could not join the network:", err)
+	}
+}
+
+// JoinNetworkContext adds the known contact to the routing table, looks up our
+// own ID and refreshes the buckets further away than our closest neighbour
+func (kademlia *Kademlia) JoinNetworkContext(ctx context.Context, knownContact *Contact) error {
 	//1. Create ID if not exists
 	if kademlia.Self.ID == nil {
 		kademlia.Self.ID = NewRandomKademliaID()
 	}
 
 	//2. Insert known contact into routing table (correct bucket)
-	kademlia.RoutingTable.AddContact(*knownContact)
+	kademlia.updateRoutingTable(*knownContact)
 
 	//3. Run an Iterative Find Node on Self
-	kademlia.IterativeFindNode(kademlia.Self.ID, 3, 20)
+	if _, err := kademlia.IterativeFindNodeContext(ctx, kademlia.Self.ID, kademlia.Config.Alpha, kademlia.Config.K); err != nil {
+		return err
+	}
 
-	//4. Refresh bucket further away than closest
-	// neighbor
+	//4. Refresh every bucket further away than the one of our closest neighbor
 	closest := kademlia.RoutingTable.FindClosestContacts(kademlia.Self.ID, 1)
-	bucketIndex := kademlia.RoutingTable.getBucketIndex(closest[0].ID)
-	for i := bucketIndex + 1; i < IDLength*8; i++ {
-		kademlia.RefreshBucket(i)
+	if len(closest) == 0 {
+		return nil
 	}
+	bucketIndex := kademlia.RoutingTable.BucketIndex(closest[0].ID)
+	for i := 0; i < bucketIndex; i++ {
+		if err := kademlia.RefreshBucketContext(ctx, i); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// updateRoutingTable adds the contact to the routing table. When its bucket
+// is full the least-recently seen contact is pinged, and it is only
+// replaced by the new contact if it does not respond
+func (kademlia *Kademlia) updateRoutingTable(contact Contact) {
+	leastRecentlySeen := kademlia.RoutingTable.AddContact(contact)
+	if leastRecentlySeen == nil {
+		return
+	}
+
+	go func(head Contact) {
+		err := kademlia.SendPing(&head)
+		kademlia.RoutingTable.ResolvePing(head, err == nil)
+	}(*leastRecentlySeen)
+}
+
+// RefreshBucket is RefreshBucketContext with the context of the node
 func (kademlia *Kademlia) RefreshBucket(idx int) {
-	contact := kademlia.RoutingTable.buckets[idx].getContactForBucketRefresh()
-	if contact.ID != nil {
-		kademlia.IterativeFindNode(contact.ID, 3, 20)
+	kademlia.RefreshBucketContext(kademlia.ctx, idx)
+}
+
+// RefreshBucketContext looks up a random ID in the range of the bucket at index idx
+func (kademlia *Kademlia) RefreshBucketContext(ctx context.Context, idx int) error {
+	target := kademlia.RoutingTable.RefreshTarget(idx)
+	if target == nil {
+		return nil
+	}
+	_, err := kademlia.IterativeFindNodeContext(ctx, target, kademlia.Config.Alpha, kademlia.Config.K)
+	return err
+}
+
+// maintain runs in the background until the node is closed. It refreshes
+// every bucket that saw no activity for the refresh interval, deletes
+// the stored values whose TTL expired and saves the routing table
+func (kademlia *Kademlia) maintain() {
+	checkInterval := min(kademlia.Config.RefreshInterval, time.Minute)
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kademlia.ctx.Done():
+			return
+		case <-ticker.C:
+			idleSince := time.Now().Add(-kademlia.Config.RefreshInterval)
+			for _, target := range kademlia.RoutingTable.IdleBuckets(idleSince) {
+				kademlia.IterativeFindNode(target, kademlia.Config.Alpha, kademlia.Config.K)
+			}
+			kademlia.DataStore.Clean()
+			if err := kademlia.saveRoutingTable(); err != nil {
+				log.Printf("Could not save routing table: %v", err)
+			}
+		}
 	}
 }
 
+// Close saves the routing table and stops the background work of the node and its network,
+// the RPCs and lookups using the context of the node are abandoned
+func (kademlia *Kademlia) Close() error {
+	var err error
+	kademlia.closeOnce.Do(func() {
+		kademlia.stop()
+		if saveErr := kademlia.saveRoutingTable(); saveErr != nil {
+			log.Printf("Could not save routing table: %v", saveErr)
+		}
+		err = kademlia.Network.Close()
+	})
+	return err
+}
+
 // Helper function to get the outbound IP address
 func getOutboundIP() (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
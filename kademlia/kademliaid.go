@@ -1,10 +1,10 @@
 package kademlia
 
 import (
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
 	"time"
 	"unicode/utf8"
 )
@@ -27,12 +27,12 @@ func NewKademliaID(data string) *KademliaID {
 	return &newKademliaID
 }
 
-// NewRandomKademliaID returns a new instance of a random KademliaID,
-// change this to a better version if you like
+// NewRandomKademliaID returns a new instance of a random KademliaID
+// read from the cryptographically secure random number generator
 func NewRandomKademliaID() *KademliaID {
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = uint8(rand.Intn(256))
+	if _, err := rand.Read(newKademliaID[:]); err != nil {
+		panic(fmt.Sprintf("cannot read random bytes: %v", err))
 	}
 	return &newKademliaID
 }
@@ -67,6 +67,11 @@ func (kademliaID KademliaID) CalcDistance(target *KademliaID) *KademliaID {
 	return &result
 }
 
+// bit returns the i:th most significant bit of the KademliaID
+func (kademliaID KademliaID) bit(i int) byte {
+	return (kademliaID[i/8] >> uint(7-i%8)) & 0x1
+}
+
 // String returns a simple string representation of a KademliaID
 func (kademliaID *KademliaID) String() string {
 	return hex.EncodeToString(kademliaID[0:IDLength])
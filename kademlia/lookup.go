@@ -0,0 +1,295 @@
+package kademlia
+
+import (
+	"context"
+	"time"
+)
+
+// LookupStrategy is the part of a lookup specific to its kind: what is sent to each
+// contact, what is kept of the answers and when to stop before reaching the k closest.
+// Query is called concurrently, Merge and Done are called by the lookup one at a time
+type LookupStrategy interface {
+	// Query sends the RPC of the lookup to the contact and returns its answer
+	Query(ctx context.Context, contact Contact) LookupResponse
+	// Merge handles the answer of a contact that did not fail and returns
+	// the contacts to add to the shortlist
+	Merge(resp LookupResponse) []Contact
+	// Done returns true once the lookup found what it was looking for
+	Done() bool
+}
+
+// LookupResponse is the answer of a contact queried during a lookup
+type LookupResponse struct {
+	From     Contact
+	Contacts []Contact
+	Value    *string     // The value, for lookups of a value
+	Payload  interface{} // Anything else a kind of lookup receives
+	Round    int         // Set by the lookup, see TraceQuery
+	Err      error
+}
+
+// LookupResult is the outcome of a lookup
+type LookupResult struct {
+	Contacts []Contact // The k closest contacts to the target
+	Answered []Contact // Every contact that answered, with its distance to the target
+}
+
+// Lookup asks contacts ever closer to the target for the contacts they know, using the
+// strategy to query them. It keeps alpha queries in flight: a new contact is queried as
+// soon as a query is answered, fails or is stale, that is unanswered after StaleTimeout.
+// Stale queries stop counting towards alpha but their answers are still used.
+// Once alpha answers in a row bring nothing closer, every contact of the k closest not
+// queried yet is queried at once. The lookup ends when the strategy is done, or when the
+// k closest contacts have all answered, those that failed being dropped and replaced by
+// the next closest contacts known.
+// If the context is done first, its error is returned with the closest contacts so far.
+// The queries are recorded in the trace of the context, if any
+func (kademlia *Kademlia) Lookup(ctx context.Context, target *KademliaID, alpha int, kSize int, strategy LookupStrategy) (result LookupResult, err error) {
+	trace := traceFromContext(ctx)
+	trace.start(target)
+	defer func() { trace.end(strategy.Done(), err) }()
+
+	kademlia.RoutingTable.Touch(target)
+	candidates := &ContactCandidates{}
+	candidates.Append(kademlia.RoutingTable.FindClosestContacts(target, kSize))
+	candidates.SortWithTarget(target)
+	failed := make(map[string]bool)
+	// Never add ourselves to the shortlist, even if a peer returns us as a contact
+	failed[kademlia.Self.ID.String()] = true
+	// Lookups of a batch also start from the contacts learned by the others
+	pool := contactPoolFromContext(ctx)
+	candidates.mergeAndSort(pool.closest(target, kSize), target, kSize, failed)
+	// The contacts known before the lookup are queried in the first round,
+	// those returned by a query of a round in the next one
+	rounds := make(map[string]int)
+	for _, contact := range candidates.contacts {
+		rounds[contact.ID.String()] = 1
+	}
+	traced := make(map[string]int) // Index of the queries in the trace
+
+	queried := make(map[string]bool)
+	pending := make(map[string]time.Time) // Queries in flight and when they were sent
+	stale := make(map[string]bool)
+	active := 0 // Queries in flight that are not stale
+
+	responseChan := make(chan LookupResponse)
+	done := make(chan struct{})
+	defer close(done)
+
+	closestSoFar := candidates.closestDistance()
+	withoutProgress := 0
+
+	for {
+		width := alpha
+		if withoutProgress >= alpha {
+			width = kSize
+		}
+		shortlist := candidates.closest(kSize)
+		for _, contact := range shortlist.pickAlpha(queried, width-active) {
+			id := contact.ID.String()
+			queried[id] = true
+			pending[id] = time.Now()
+			traced[id] = trace.query(rounds[id], contact)
+			active++
+			go func(contact Contact) {
+				resp := strategy.Query(ctx, contact)
+				resp.From = contact
+				select {
+				case responseChan <- resp:
+				case <-done:
+				}
+			}(contact)
+		}
+
+		if shortlist.settled(queried, pending) {
+			break
+		}
+
+		var staleTimer <-chan time.Time
+		if next, ok := nextStale(pending, stale); ok {
+			staleTimer = time.After(time.Until(next.Add(kademlia.Config.StaleTimeout)))
+		}
+
+		select {
+		case <-ctx.Done():
+			result.Contacts = candidates.GetContacts(min(candidates.Len(), kSize))
+			return result, ctx.Err()
+
+		case <-staleTimer:
+			for id, sent := range pending {
+				if !stale[id] && time.Since(sent) >= kademlia.Config.StaleTimeout {
+					stale[id] = true
+					trace.stale(traced[id])
+					active--
+				}
+			}
+
+		case resp := <-responseChan:
+			id := resp.From.ID.String()
+			sent := pending[id]
+			delete(pending, id)
+			if stale[id] {
+				delete(stale, id)
+			} else {
+				active--
+			}
+
+			if resp.Err != nil {
+				if ctx.Err() != nil {
+					// The query was abandoned, the contact did not fail
+					continue
+				}
+				// Unresponsive nodes are dropped from the shortlist
+				failed[id] = true
+				candidates.remove(resp.From.ID)
+				pool.forget(resp.From.ID)
+				trace.answer(traced[id], sent, resp, candidates.closestDistance())
+				continue
+			}
+
+			resp.From.CalcDistance(target)
+			resp.Round = rounds[id]
+			result.Answered = append(result.Answered, resp.From)
+			contacts := strategy.Merge(resp)
+			pool.learn(resp.From)
+			pool.learn(contacts...)
+			for _, contact := range contacts {
+				if _, ok := rounds[contact.ID.String()]; !ok {
+					rounds[contact.ID.String()] = rounds[id] + 1
+				}
+			}
+			candidates.merge(contacts, target, failed)
+			trace.answer(traced[id], sent, resp, candidates.closestDistance())
+
+			if strategy.Done() {
+				result.Contacts = candidates.GetContacts(min(candidates.Len(), kSize))
+				return result, nil
+			}
+			if candidates.closerThan(closestSoFar) {
+				withoutProgress = 0
+			} else {
+				withoutProgress++
+			}
+			closestSoFar = candidates.closestDistance()
+		}
+	}
+
+	result.Contacts = candidates.GetContacts(min(candidates.Len(), kSize))
+	return result, nil
+}
+
+// nextStale returns the time the oldest query that is not stale yet was sent
+func nextStale(pending map[string]time.Time, stale map[string]bool) (time.Time, bool) {
+	var oldest time.Time
+	found := false
+	for id, sent := range pending {
+		if !stale[id] && (!found || sent.Before(oldest)) {
+			oldest, found = sent, true
+		}
+	}
+	return oldest, found
+}
+
+func (c *ContactCandidates) pickAlpha(queried map[string]bool, alpha int) []Contact {
+	toQuery := []Contact{}
+	for _, contact := range c.contacts {
+		if len(toQuery) >= alpha {
+			break
+		}
+		if !queried[contact.ID.String()] {
+			toQuery = append(toQuery, contact)
+		}
+	}
+	return toQuery
+}
+
+// settled returns true if every candidate was queried and none of them is still pending
+func (c *ContactCandidates) settled(queried map[string]bool, pending map[string]time.Time) bool {
+	for _, contact := range c.contacts {
+		id := contact.ID.String()
+		if !queried[id] {
+			return false
+		}
+		if _, ok := pending[id]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// closestDistance returns the distance of the closest candidate to the target, nil if there is none
+func (c *ContactCandidates) closestDistance() *KademliaID {
+	if c.Len() == 0 {
+		return nil
+	}
+	return c.contacts[0].distance
+}
+
+// closerThan returns true if the closest candidate is closer to the target than
+// the distance, or if there was no candidate at that distance yet
+func (c *ContactCandidates) closerThan(distance *KademliaID) bool {
+	closest := c.closestDistance()
+	if closest == nil {
+		return false
+	}
+	return distance == nil || closest.Less(distance)
+}
+
+// mergeAndSort adds the new contacts to the candidates, except those in failed,
+// and keeps the kSize closest to the target. It returns true if a contact was added
+func (c *ContactCandidates) mergeAndSort(newContacts []Contact, target *KademliaID, kSize int, failed map[string]bool) bool {
+	progress := c.merge(newContacts, target, failed)
+	if c.Len() > kSize {
+		c.contacts = c.GetContacts(kSize)
+	}
+	return progress
+}
+
+// merge adds the new contacts to the candidates, except those in failed, and sorts
+// them by distance to the target. It returns true if a contact was added
+func (c *ContactCandidates) merge(newContacts []Contact, target *KademliaID, failed map[string]bool) bool {
+	progress := false
+	for _, nc := range newContacts {
+		nc.CalcDistance(target)
+		if !failed[nc.ID.String()] && !containsContact(c.contacts, nc) {
+			c.Append([]Contact{nc})
+			progress = true
+		}
+	}
+
+	c.SortWithTarget(target)
+	return progress
+}
+
+// closest returns the kSize closest candidates, sharing the contacts of c
+func (c *ContactCandidates) closest(kSize int) *ContactCandidates {
+	return &ContactCandidates{contacts: c.contacts[:min(c.Len(), kSize)]}
+}
+
+// remove drops the contact with the given ID from the candidates
+func (c *ContactCandidates) remove(id *KademliaID) {
+	for i, contact := range c.contacts {
+		if contact.ID.Equals(id) {
+			c.contacts = append(c.contacts[:i], c.contacts[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *ContactCandidates) SortWithTarget(target *KademliaID) {
+	for i := range c.contacts {
+		if c.contacts[i].distance == nil {
+			c.contacts[i].CalcDistance(target)
+		}
+	}
+	c.Sort()
+}
+
+func containsContact(list []Contact, c Contact) bool {
+	for _, x := range list {
+		if x.ID.Equals(c.ID) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,9 @@
 package kademlia
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type MessageType string
 
@@ -21,23 +24,34 @@ type Message struct {
 	To      Contact // Do i need to include the To field in the Ping message?
 	Payload []byte
 	RPCID   KademliaID // Unique ID for matching requests and responses
+	// ed25519 public key of the sender and its signature of the message, see signedBytes
+	PublicKey []byte
+	Signature []byte
+	// Protocol version and capabilities of the sender, sent with every message but PING
+	// and PONG, which carry a Hello, to the peers that decode them, see CapSenderHeader
+	Version      int        `json:",omitempty"`
+	Capabilities Capability `json:",omitempty"`
 }
 
+// NewPingMessage returns a PING advertising the version and capabilities of from
 func NewPingMessage(from Contact, rpcID KademliaID, to Contact) *Message {
 	return &Message{
-		Type:  PING,
-		From:  from,
-		RPCID: rpcID,
-		To:    to,
+		Type:    PING,
+		From:    from,
+		RPCID:   rpcID,
+		To:      to,
+		Payload: newHelloPayload(from),
 	}
 }
 
+// NewPongMessage returns a PONG advertising the version and capabilities of from
 func NewPongMessage(from Contact, rpcID KademliaID, to Contact) *Message {
 	return &Message{
-		Type:  PONG,
-		From:  from,
-		RPCID: rpcID,
-		To:    to,
+		Type:    PONG,
+		From:    from,
+		RPCID:   rpcID,
+		To:      to,
+		Payload: newHelloPayload(from),
 	}
 }
 
@@ -63,8 +77,28 @@ func ResponseFindNodeMessage(from Contact, rpcID KademliaID, to Contact, contact
 	}
 }
 
+// StorePayload is the payload of a STORE message. Cached copies, stored along
+// the path of a lookup, are kept for TTL and never treated as primary replicas.
+// Primary replicas are sent as the value alone, which every version decodes
+type StorePayload struct {
+	Value string
+	Cache bool          `json:",omitempty"`
+	TTL   time.Duration `json:",omitempty"`
+}
+
 func NewStoreMessage(from Contact, rpcID KademliaID, to Contact, data string) *Message {
-	dataBytes, _ := json.Marshal(data)
+	return NewStorePayloadMessage(from, rpcID, to, StorePayload{Value: data})
+}
+
+// NewStorePayloadMessage returns a STORE message, which may ask for a cached copy.
+// Only the contacts advertising CapCachedStore decode the request of a cached copy
+func NewStorePayloadMessage(from Contact, rpcID KademliaID, to Contact, payload StorePayload) *Message {
+	var dataBytes []byte
+	if payload.Cache {
+		dataBytes, _ = json.Marshal(payload)
+	} else {
+		dataBytes, _ = json.Marshal(payload.Value)
+	}
 	return &Message{
 		Type:    STORE,
 		From:    from,
@@ -2,20 +2,28 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/ed25519"
 	"d7024e/storage"
 	"errors"
+	"log"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // SimulatedNetwork acts as an in-memory message bus for Kademlia nodes.
 type SimulatedNetwork struct {
-	nodes map[string]*Kademlia // Map address string to Kademlia instance
-	mu    sync.Mutex
+	nodes    map[string]*Kademlia // Map address string to Kademlia instance
+	mu       sync.Mutex
+	dropRate float64                  // Fraction of the messages that are silently lost
+	delays   map[string]time.Duration // Time the messages to an address take to arrive
 }
 
 func NewSimulatedNetwork() *SimulatedNetwork {
 	return &SimulatedNetwork{
-		nodes: make(map[string]*Kademlia),
+		nodes:  make(map[string]*Kademlia),
+		delays: make(map[string]time.Duration),
 	}
 }
 
@@ -26,6 +34,20 @@ func (s *SimulatedNetwork) AddNode(node *Kademlia) {
 	s.nodes[node.Self.Address] = node
 }
 
+// SetDropRate makes the simulation silently drop the given fraction (0 to 1) of the messages.
+func (s *SimulatedNetwork) SetDropRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropRate = rate
+}
+
+// SetDelay makes every message sent to the address arrive after the given delay.
+func (s *SimulatedNetwork) SetDelay(addr string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delays[addr] = delay
+}
+
 // MockNetworkAdapter is a per-node view of the network that implements NetworkAPI
 type MockNetworkAdapter struct {
 	node *Kademlia
@@ -36,15 +58,23 @@ type MockNetworkAdapter struct {
 func (m *MockNetworkAdapter) SendMessage(addr string, msg *Message) error {
 	m.sim.mu.Lock()
 	targetNode, found := m.sim.nodes[addr]
+	dropped := rand.Float64() < m.sim.dropRate
+	delay := m.sim.delays[addr]
 	m.sim.mu.Unlock()
 
 	if !found {
 		return errors.New("node not found in simulation: " + addr)
 	}
+	if dropped {
+		return nil
+	}
 
 	// "Deliver" the message by directly calling the target's handler
 	// Run in a goroutine to better simulate real network asynchronicity
-	go targetNode.HandleMessage(*msg, nil) // addr is nil, not needed for sim
+	go func(msg Message) {
+		time.Sleep(delay)
+		targetNode.HandleMessage(msg, nil) // addr is nil, not needed for sim
+	}(*msg)
 	return nil
 }
 
@@ -53,19 +83,41 @@ func (m *MockNetworkAdapter) Listen() error {
 	return nil
 }
 
-func NewTestKademliaNode(address string, sim *SimulatedNetwork) *Kademlia {
+// Close removes the node from the simulation.
+func (m *MockNetworkAdapter) Close() error {
+	m.sim.mu.Lock()
+	defer m.sim.mu.Unlock()
+	delete(m.sim.nodes, m.node.Self.Address)
+	return nil
+}
+
+func NewTestKademliaNode(address string, sim *SimulatedNetwork, config Config) *Kademlia {
+	config = config.withDefaults()
+	id, privateKey, err := newNodeIdentity(config)
+	if err != nil {
+		log.Printf("Could not load node ID, using a random one: %v", err)
+		id = NewRandomKademliaID()
+		_, privateKey, _ = ed25519.GenerateKey(nil)
+	}
 	contact := Contact{
-		ID:      NewRandomKademliaID(),
-		Address: address,
+		ID:           id,
+		Address:      address,
+		Version:      ProtocolVersion,
+		Capabilities: supportedCapabilities,
 	}
-	rt := NewRoutingTable(contact)
+	rt := NewRoutingTableWithConfig(contact, config)
 
 	// 1. Create the Kademlia struct instance first.
+	ctx, stop := context.WithCancel(context.Background())
 	kademliaNode := &Kademlia{
 		Self:         contact,
 		RoutingTable: rt,
-		DataStore:    *storage.NewStorage(),
+		DataStore:    *storage.NewStorageWithTTL(config.TTL),
 		mapManagerCh: make(chan MapRequest),
+		Config:       config,
+		privateKey:   privateKey,
+		ctx:          ctx,
+		stop:         stop,
 	}
 
 	// 2. Create the mock network adapter for this specific node.
@@ -81,5 +133,6 @@ func NewTestKademliaNode(address string, sim *SimulatedNetwork) *Kademlia {
 	sim.AddNode(kademliaNode)
 
 	go kademliaNode.managePendingRequests()
+	go kademliaNode.maintain()
 	return kademliaNode
 }
@@ -1,49 +1,99 @@
 package kademlia
 
 import (
-	"encoding/json"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type NetworkAPI interface {
 	Listen() error
 	SendMessage(addr string, msg *Message) error
+	Close() error
 }
 
+// Network sends messages over UDP with the preferred Codec to the peers that
+// support it, and in JSON to the others. Messages are decoded with the codec
+// that encoded them, whatever the preferred one.
+//
+// Messages to a peer we made a session with are encrypted, see session. With Encrypt
+// a session is made with every peer before sending it anything, and the messages
+// received in the clear are dropped.
+//
+// Packets larger than maxDatagramSize are split into fragments for the peers that
+// reassemble them, and sent whole to the others
 type Network struct {
 	Self      Contact
 	Conn      *net.UDPConn
+	Codec     Codec
+	Encrypt   bool
+	identity  ed25519.PrivateKey                                     // Key the handshakes are signed with
+	verifyKey func(id *KademliaID, publicKey ed25519.PublicKey) bool // Checks the key a peer signed its handshake with
+	sessions  *sessionCache
+	fragments *reassembler
+	messageID atomic.Uint32 // ID of the last message sent in fragments
 	onMessage func(msg Message, addr *net.UDPAddr)
 }
 
-func NewNetwork(self Contact, conn *net.UDPConn, handler func(msg Message, addr *net.UDPAddr)) *Network {
-	return &Network{
+func NewNetwork(self Contact, conn *net.UDPConn, codec Codec, handler func(msg Message, addr *net.UDPAddr)) *Network {
+	network := &Network{
 		Self:      self,
 		Conn:      conn,
+		Codec:     codec,
+		sessions:  newSessionCache(),
+		fragments: newReassembler(),
 		onMessage: handler,
 	}
+	// Start from a random ID so that the fragments sent before a restart are not mixed with the new ones
+	var id [4]byte
+	rand.Read(id[:])
+	network.messageID.Store(binary.BigEndian.Uint32(id[:]))
+	return network
 }
 
 func (network *Network) Listen() error {
 	// Create a UDP listener
 	defer network.Conn.Close()
+	buffer := make([]byte, maxReadSize)
 	for {
 
-		buffer := make([]byte, 20480)
 		len, remoteAddr, err := network.Conn.ReadFromUDP(buffer)
 
 		log.Printf("DEBUG: Received %d bytes from %s", len, remoteAddr)
 
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			fmt.Println("Error reading from UDP:", err)
 			continue
 		}
 
-		var msg Message
-		if err := json.Unmarshal(buffer[:len], &msg); err != nil {
-			fmt.Println("Error unmarshaling message:", err)
+		packet := buffer[:len]
+		if len > 0 && packet[0] == fragmentPacket {
+			packet, err = network.fragments.add(remoteAddr.String(), packet, time.Now())
+			if err != nil {
+				fmt.Println("Error reassembling message:", err)
+			}
+			if packet == nil {
+				continue
+			}
+		}
+
+		data, ok := network.unseal(packet, remoteAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := SniffCodec(data).Decode(data)
+		if err != nil {
+			fmt.Println("Error decoding message:", err)
 			continue
 		}
 
@@ -60,12 +110,77 @@ func (network *Network) SendMessage(addr string, msg *Message) error {
 		return err
 	}
 
-	data, err := json.Marshal(msg)
+	data, err := codecFor(network.Codec, msg.To).Encode(msg)
 	if err != nil {
-		fmt.Println("Error marshaling message:", err)
+		fmt.Println("Error encoding message:", err)
 		return err
 	}
 
+	session := network.sessions.get(udpAddr.String(), msg.To.ID)
+	if session == nil && network.Encrypt {
+		if session, err = network.handshake(udpAddr, msg.To.ID); err != nil {
+			return err
+		}
+	}
+	if session != nil {
+		data = session.seal(data)
+	}
+
+	if len(data) > maxDatagramSize && msg.To.Supports(CapFragments) {
+		return network.sendFragments(data, udpAddr)
+	}
 	_, err = network.Conn.WriteToUDP(data, udpAddr)
 	return err
 }
+
+// sendFragments sends the packet in fragments of at most maxDatagramSize bytes
+func (network *Network) sendFragments(packet []byte, addr *net.UDPAddr) error {
+	fragments, err := fragment(packet, network.messageID.Add(1))
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		if _, err := network.Conn.WriteToUDP(fragment, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unseal returns the encoded message carried by the packet, decrypted if it was sealed.
+// Handshakes are handled here and carry no message
+func (network *Network) unseal(packet []byte, addr *net.UDPAddr) ([]byte, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+
+	switch packet[0] {
+	case handshakeInit, handshakeReply:
+		if err := network.handleHandshake(packet, addr); err != nil {
+			fmt.Println("Error in handshake with", addr, err)
+		}
+		return nil, false
+	case sealedMessage:
+		data, err := network.sessions.open(packet, addr.String())
+		if errors.Is(err, errUnknownSession) && network.sessions.allowRedial(addr.String(), time.Now()) {
+			// The peer may have restarted and lost the session, make a new one
+			go network.handshake(addr, nil)
+		}
+		if err != nil {
+			fmt.Println("Error decrypting message:", err)
+			return nil, false
+		}
+		return data, true
+	}
+
+	if network.Encrypt {
+		fmt.Println("Dropping message sent in the clear by", addr)
+		return nil, false
+	}
+	return packet, true
+}
+
+// Close stops listening and releases the UDP port
+func (network *Network) Close() error {
+	return network.Conn.Close()
+}
@@ -0,0 +1,132 @@
+package kademlia
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const nodeIDFile = "node_id"
+const routingTableFile = "routing_table.json"
+
+// routingTableFileContent is the content of the routing table file
+type routingTableFileContent struct {
+	Contacts []Contact
+}
+
+// loadOrCreateNodeID returns the node ID saved in the data directory. If there
+// is none, a new random ID is created and saved. Without a data directory a
+// new random ID is returned
+func loadOrCreateNodeID(dataDir string) (*KademliaID, error) {
+	if dataDir == "" {
+		return NewRandomKademliaID(), nil
+	}
+
+	path := filepath.Join(dataDir, nodeIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(decoded) != IDLength {
+			return nil, fmt.Errorf("invalid node ID in %s", path)
+		}
+		return NewKademliaID(hex.EncodeToString(decoded)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	id := NewRandomKademliaID()
+	if err := writeFileAtomic(path, []byte(id.String()+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// saveRoutingTable writes the contacts of the routing table to the data directory
+func (kademlia *Kademlia) saveRoutingTable() error {
+	if kademlia.Config.DataDir == "" {
+		return nil
+	}
+
+	snapshot := routingTableFileContent{Contacts: kademlia.RoutingTable.AllContacts()}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(kademlia.Config.DataDir, routingTableFile), data, 0o644)
+}
+
+// loadRoutingTable reads the contacts saved in the data directory
+func loadRoutingTable(dataDir string) ([]Contact, error) {
+	if dataDir == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, routingTableFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot routingTableFileContent
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot.Contacts, nil
+}
+
+// RestoreRoutingTable pings every contact saved in the data directory by a
+// previous run. The contacts that answer are added back to the routing table
+// and their number is returned
+func (kademlia *Kademlia) RestoreRoutingTable() (int, error) {
+	contacts, err := loadRoutingTable(kademlia.Config.DataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	alive := 0
+	for _, contact := range contacts {
+		if contact.ID == nil || contact.ID.Equals(kademlia.Self.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			// The PONG adds the contact to the routing table
+			if kademlia.SendPing(&contact) == nil {
+				mu.Lock()
+				alive++
+				mu.Unlock()
+			}
+		}(contact)
+	}
+	wg.Wait()
+
+	return alive, nil
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it,
+// so that a crash never leaves a half written file behind. The file is given perm
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	// A temporary file left by a crash would keep its permissions
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,66 @@
+package kademlia
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeIDPersistence(t *testing.T) {
+	t.Run("Same ID across restarts", func(t *testing.T) {
+		dir := t.TempDir()
+
+		first, err := loadOrCreateNodeID(dir)
+		require.NoError(t, err)
+		second, err := loadOrCreateNodeID(dir)
+		require.NoError(t, err)
+
+		assert.True(t, first.Equals(second), "Node ID should be reloaded from the data directory")
+	})
+
+	t.Run("Random ID without data directory", func(t *testing.T) {
+		first, _ := loadOrCreateNodeID("")
+		second, _ := loadOrCreateNodeID("")
+
+		assert.False(t, first.Equals(second))
+	})
+
+	t.Run("Corrupted ID file", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, nodeIDFile), []byte("nothex"), 0o644))
+
+		_, err := loadOrCreateNodeID(dir)
+		assert.Error(t, err)
+	})
+}
+
+func TestRoutingTablePersistence(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.DataDir = dir
+
+	sim := NewSimulatedNetwork()
+	nodeA := NewTestKademliaNode("nodeA", sim, config)
+	nodeB := NewTestKademliaNode("nodeB", sim, DefaultConfig())
+	gone := NewTestKademliaNode("gone", sim, DefaultConfig())
+	nodeA.RoutingTable.AddContact(nodeB.Self)
+	nodeA.RoutingTable.AddContact(gone.Self)
+	require.NoError(t, nodeA.Close())
+	gone.Close()
+
+	saved, err := loadRoutingTable(dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{nodeB.Self.ID.String(), gone.Self.ID.String()}, getIDs(saved))
+
+	// Restart nodeA from the same data directory
+	restarted := NewTestKademliaNode("nodeA", sim, config)
+	assert.True(t, restarted.Self.ID.Equals(nodeA.Self.ID), "Restarted node should keep its ID")
+
+	alive, err := restarted.RestoreRoutingTable()
+	require.NoError(t, err)
+	assert.Equal(t, 1, alive, "Only nodeB should answer")
+	assert.Equal(t, []string{nodeB.Self.ID.String()}, getIDs(restarted.RoutingTable.AllContacts()))
+}
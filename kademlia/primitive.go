@@ -1,78 +1,166 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 )
 
-func (kademlia *Kademlia) SendPing(contact *Contact) error {
-	rpcID := NewRandomKademliaID()
+// ErrRPCTimeout is returned when a contact does not answer an RPC in time
+var ErrRPCTimeout = errors.New("rpc timed out")
+
+// ErrValueMismatch is returned when a contact answers FIND_VALUE with a value
+// whose SHA-1 hash is not the requested key
+var ErrValueMismatch = errors.New("value does not match its key")
 
-	responseChan := make(chan Message, 1)
+// ErrNotStored is returned when a contact answers a STORE without storing the value
+var ErrNotStored = errors.New("value not stored")
+
+// ErrCacheNotSupported is returned when asking a contact that did not advertise
+// CapCachedStore to keep a cached copy, it would store it as a primary replica
+var ErrCacheNotSupported = errors.New("contact does not keep cached copies")
+
+// sendRequest sends the request to the contact and waits for the response
+// with the same RPC ID. If the contact cannot be reached or does not answer
+// within the RPC timeout a failure is reported to the routing table.
+// If the context is done first the request is abandoned and its error returned
+func (kademlia *Kademlia) sendRequest(ctx context.Context, contact *Contact, msg *Message) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
 
 	req := MapRequest{
-		rpcID:        *rpcID,
-		responseChan: responseChan,
+		rpcID:        msg.RPCID,
+		responseChan: make(chan Message, 1),
 		register:     true,
 	}
-
 	kademlia.mapManagerCh <- req
 
+	err := kademlia.sendMessage(contact.Address, msg)
+	if err != nil {
+		kademlia.cancelRequest(msg.RPCID)
+		kademlia.contactFailed(contact)
+		return Message{}, fmt.Errorf("failed to send %s: %w", msg.Type, err)
+	}
+
+	select {
+	case resp := <-req.responseChan:
+		return resp, nil
+	case <-ctx.Done():
+		kademlia.cancelRequest(msg.RPCID)
+		return Message{}, ctx.Err()
+	case <-time.After(kademlia.Config.RPCTimeout):
+		kademlia.cancelRequest(msg.RPCID)
+		kademlia.contactFailed(contact)
+		return Message{}, fmt.Errorf("%s to %s: %w", msg.Type, contact.Address, ErrRPCTimeout)
+	}
+}
+
+// sendMessage signs the message and sends it. The recipient is given the capabilities
+// it advertised, if it is in the routing table, so that the network only uses the
+// encodings it supports. The version and capabilities of the node are sent along to
+// the recipients that decode them, or that advertised nothing yet so that they learn them
+func (kademlia *Kademlia) sendMessage(addr string, msg *Message) error {
+	msg.To = kademlia.withCapabilities(msg.To)
+	if msg.Type != PING && msg.Type != PONG && (msg.To.Version == 0 || msg.To.Supports(CapSenderHeader)) {
+		msg.Version, msg.Capabilities = kademlia.Self.Version, kademlia.Self.Capabilities
+	}
+	kademlia.sign(msg)
+	return kademlia.Network.SendMessage(addr, msg)
+}
+
+// withCapabilities returns the contact with the version and capabilities it advertised,
+// if it is in the routing table and they are not known already
+func (kademlia *Kademlia) withCapabilities(contact Contact) Contact {
+	if contact.Version == 0 && contact.ID != nil {
+		if known, ok := kademlia.RoutingTable.GetContact(contact.ID); ok {
+			contact.Version, contact.Capabilities = known.Version, known.Capabilities
+		}
+	}
+	return contact
+}
+
+// valueMatchesKey returns true if the SHA-1 hash of the value is the key
+func valueMatchesKey(value string, key *KademliaID) bool {
+	hash := sha1.Sum([]byte(value))
+	return KademliaID(hash).Equals(key)
+}
+
+// cancelRequest forgets a pending request that will not be answered
+func (kademlia *Kademlia) cancelRequest(rpcID KademliaID) {
+	kademlia.mapManagerCh <- MapRequest{
+		rpcID:  rpcID,
+		cancel: true,
+	}
+}
+
+// contactFailed reports a contact that did not answer to the routing table,
+// which removes it after too many consecutive failures
+func (kademlia *Kademlia) contactFailed(contact *Contact) {
+	if contact.ID == nil {
+		return
+	}
+	if kademlia.RoutingTable.ReportFailure(*contact) {
+		fmt.Printf("Removed unresponsive contact %s\n", contact.String())
+	}
+}
+
+// SendPing is SendPingContext with the context of the node
+func (kademlia *Kademlia) SendPing(contact *Contact) error {
+	return kademlia.SendPingContext(kademlia.ctx, contact)
+}
+
+// SendPingContext pings the contact, it returns nil if the contact answered
+func (kademlia *Kademlia) SendPingContext(ctx context.Context, contact *Contact) error {
+	rpcID := NewRandomKademliaID()
+
 	pingMsg := NewPingMessage(kademlia.Self, *rpcID, *contact)
 
 	fmt.Printf("PING message: %+v\n", pingMsg)
 	fmt.Printf("Sending PING to %s \n", contact.Address)
 
-	err := kademlia.Network.SendMessage(contact.Address, pingMsg)
+	pongMsg, err := kademlia.sendRequest(ctx, contact, pingMsg)
 	if err != nil {
-		return fmt.Errorf("failed to send ping: %w", err)
+		return fmt.Errorf("ping to %s failed: %w", contact.Address, err)
 	}
 
-	select {
-	case pongMsg := <-responseChan:
-		fmt.Printf("Received PONG from %s with ID %s\n", contact.Address, hex.EncodeToString(pongMsg.RPCID[:]))
-		return nil
+	fmt.Printf("Received PONG from %s with ID %s\n", contact.Address, hex.EncodeToString(pongMsg.RPCID[:]))
+	return nil
+}
 
-	case <-time.After(3 * time.Second):
-		return fmt.Errorf("ping to %s timed out", contact.Address)
+// FindNode asks the contact for the k closest contacts it knows to the target.
+// The boolean is false if the contact did not answer
+func (kademlia *Kademlia) FindNode(contact *Contact, target *KademliaID) ([]Contact, bool, *string) {
+	contacts, err := kademlia.FindNodeContext(kademlia.ctx, contact, target)
+	if err != nil {
+		fmt.Println("FindNode request failed:", err)
+		return []Contact{}, false, nil
 	}
+	return contacts, true, nil
 }
 
-func (kademlia *Kademlia) FindNode(contact *Contact, target *KademliaID) ([]Contact, bool, *string) {
+// FindNodeContext asks the contact for the k closest contacts it knows to the target
+func (kademlia *Kademlia) FindNodeContext(ctx context.Context, contact *Contact, target *KademliaID) ([]Contact, error) {
 	rpcID := *NewRandomKademliaID()
 
-	req := MapRequest{
-		rpcID:        rpcID,
-		responseChan: make(chan Message, 1),
-		register:     true,
-	}
-	kademlia.mapManagerCh <- req
-
 	findMsg := NewFindNodeMessage(kademlia.Self, rpcID, *contact, *target)
-	err := kademlia.Network.SendMessage(contact.Address, findMsg)
+	resp, err := kademlia.sendRequest(ctx, contact, findMsg)
 	if err != nil {
-		fmt.Println("Error sending FindNode message:", err)
-		return nil, false, nil
+		return nil, err
 	}
 
-	select {
-	case resp := <-req.responseChan:
-		if resp.Type == FIND_NODE_RESPONSE {
-			var contacts []Contact
-			if err := json.Unmarshal(resp.Payload, &contacts); err != nil {
-				fmt.Println("Error unmarshaling contacts:", err)
-				return nil, false, nil
-			}
-			return contacts, true, nil
-		}
-	case <-time.After(3 * time.Second):
-		// Timeout
-		//TODO add a breakout
-		fmt.Println("FindNode request timed out")
+	if resp.Type != FIND_NODE_RESPONSE {
+		return nil, fmt.Errorf("unexpected response %s to FIND_NODE", resp.Type)
+	}
+	var contacts []Contact
+	if err := json.Unmarshal(resp.Payload, &contacts); err != nil {
+		return nil, fmt.Errorf("error unmarshaling contacts: %w", err)
 	}
-	return []Contact{}, false, nil
+	return contacts, nil
 }
 
 // STORE
@@ -80,80 +168,90 @@ func (kademlia *Kademlia) FindNode(contact *Contact, target *KademliaID) ([]Cont
 
 // This is a primitive operation, not an iterative one.
 func (kademlia *Kademlia) Store(contact *Contact, value string, hash string) bool {
-	rpcID := *NewRandomKademliaID()
+	err := kademlia.StoreContext(kademlia.ctx, contact, value, hash)
+	if err != nil {
+		fmt.Println("Store request failed:", err)
+		return false
+	}
+	return true
+}
 
-	req := MapRequest{
-		rpcID:        rpcID,
-		responseChan: make(chan Message, 1),
-		register:     true,
+// StoreContext asks the contact to store the value, it returns nil if the value was stored
+func (kademlia *Kademlia) StoreContext(ctx context.Context, contact *Contact, value string, hash string) error {
+	return kademlia.store(ctx, contact, StorePayload{Value: value})
+}
+
+// CacheContext asks the contact to keep a cached copy of the value for ttl.
+// Contacts that did not advertise CapCachedStore are not asked
+func (kademlia *Kademlia) CacheContext(ctx context.Context, contact *Contact, value string, ttl time.Duration) error {
+	if known := kademlia.withCapabilities(*contact); !known.Supports(CapCachedStore) {
+		return ErrCacheNotSupported
 	}
-	kademlia.mapManagerCh <- req
+	return kademlia.store(ctx, contact, StorePayload{Value: value, Cache: true, TTL: ttl})
+}
 
-	storeMsg := NewStoreMessage(kademlia.Self, rpcID, *contact, value)
-	err := kademlia.Network.SendMessage(contact.Address, storeMsg)
+func (kademlia *Kademlia) store(ctx context.Context, contact *Contact, payload StorePayload) error {
+	rpcID := *NewRandomKademliaID()
+
+	storeMsg := NewStorePayloadMessage(kademlia.Self, rpcID, *contact, payload)
+	resp, err := kademlia.sendRequest(ctx, contact, storeMsg)
 	if err != nil {
-		fmt.Println("Error sending STORE message:", err)
+		return err
 	}
 
-	select {
-	case resp := <-req.responseChan:
-		if resp.Type == STORE_RESPONSE {
-			var result bool
-			if err := json.Unmarshal(resp.Payload, &result); err != nil {
-				fmt.Println("Error unmarshaling result:", err)
-				return false
-			}
-			return result
-		}
-	case <-time.After(3 * time.Second):
-		// Timeout
-		fmt.Println("Store request timed out")
-		return false
+	if resp.Type != STORE_RESPONSE {
+		return fmt.Errorf("unexpected response %s to STORE", resp.Type)
 	}
-	return false
+	var result bool
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return fmt.Errorf("error unmarshaling result: %w", err)
+	}
+	if !result {
+		return ErrNotStored
+	}
+	return nil
 }
 
 // FIND_VALUE
 func (kademlia *Kademlia) FindValue(contact *Contact, target *KademliaID) ([]Contact, bool, *string) {
-	rpcID := *NewRandomKademliaID()
-
-	req := MapRequest{
-		rpcID:        rpcID,
-		responseChan: make(chan Message, 1),
-		register:     true,
+	contacts, value, err := kademlia.FindValueContext(kademlia.ctx, contact, target)
+	if err != nil {
+		fmt.Println("FindValue request failed:", err)
+		return nil, false, nil
 	}
-	kademlia.mapManagerCh <- req
+	return contacts, value != nil, value
+}
+
+// FindValueContext asks the contact for the value stored under the target, it returns either
+// the value or the closest contacts it knows to the target, or an error if it did not answer.
+// A value whose hash is not the target is discarded and the contact removed from the routing table
+func (kademlia *Kademlia) FindValueContext(ctx context.Context, contact *Contact, target *KademliaID) ([]Contact, *string, error) {
+	rpcID := *NewRandomKademliaID()
 
 	findValueMsg := NewFindValueMessage(kademlia.Self, rpcID, *contact, *target)
-	err := kademlia.Network.SendMessage(contact.Address, findValueMsg)
+	resp, err := kademlia.sendRequest(ctx, contact, findValueMsg)
 	if err != nil {
-		fmt.Println("Error sending FindValue message:", err)
-		return nil, false, nil
+		return nil, nil, err
 	}
 
-	select {
-	case resp := <-req.responseChan:
-		if resp.Type == FIND_VALUE_RESPONSE {
-			var value *string
-			var contacts []Contact
-			if err := json.Unmarshal(resp.Payload, &value); err != nil {
-				// If unmarshaling to string fails, try unmarshaling to contacts
-				if err := json.Unmarshal(resp.Payload, &contacts); err != nil {
-					fmt.Println("Error unmarshaling value or contacts:", err)
-					return nil, false, nil
-				}
-				// If we got contacts, return them with a false flag
-				return contacts, false, nil
-			}
-			// If we got a value, return it with a true flag
-			if value == nil {
-				return contacts, false, nil // No value found, return contacts
-			}
-			return nil, true, value
+	if resp.Type != FIND_VALUE_RESPONSE {
+		return nil, nil, fmt.Errorf("unexpected response %s to FIND_VALUE", resp.Type)
+	}
+
+	var value *string
+	var contacts []Contact
+	if err := json.Unmarshal(resp.Payload, &value); err != nil {
+		// If unmarshaling to string fails, try unmarshaling to contacts
+		if err := json.Unmarshal(resp.Payload, &contacts); err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling value or contacts: %w", err)
 		}
-	case <-time.After(3 * time.Second):
-		// Timeout
-		fmt.Println("FindValue request timed out")
+		// If we got contacts, return them without a value
+		return contacts, nil, nil
+	}
+	if value != nil && !valueMatchesKey(*value, target) {
+		kademlia.RoutingTable.RemoveContact(*contact)
+		return nil, nil, fmt.Errorf("%w: %s returned a wrong value for %s", ErrValueMismatch, contact.Address, target)
 	}
-	return nil, false, nil
+	// If we got a value, return it
+	return contacts, value, nil
 }
@@ -0,0 +1,104 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ProtocolVersion is the version of the protocol spoken by this build, sent in PING and PONG.
+// Peers that send no version run a build older than version negotiation
+const ProtocolVersion = 1
+
+// Capability is a set of optional features of the protocol a node supports
+type Capability uint64
+
+const (
+	// CapBinaryCodec means the node decodes messages encoded by BinaryCodec
+	CapBinaryCodec Capability = 1 << iota
+	// CapSignedMessages means the node signs its messages, and decodes the
+	// binary messages of version 2 which carry the signature
+	CapSignedMessages
+	// CapFragments means the node reassembles the messages sent in fragments
+	CapFragments
+	// CapCachedStore means the node keeps the cached copies asked by STORE
+	// apart from its primary replicas, see StorePayload
+	CapCachedStore
+	// CapSenderHeader means the node decodes the version and capabilities of the sender
+	// in every message, and the binary messages of version 3 which carry them
+	CapSenderHeader
+)
+
+// capabilityNames names the capabilities in snapshots
+var capabilityNames = []struct {
+	capability Capability
+	name       string
+}{
+	{CapBinaryCodec, "binary-codec"},
+	{CapSignedMessages, "signed-messages"},
+	{CapFragments, "fragments"},
+	{CapCachedStore, "cached-store"},
+	{CapSenderHeader, "sender-header"},
+}
+
+// supportedCapabilities are the capabilities of this build, advertised to every peer
+const supportedCapabilities = CapBinaryCodec | CapSignedMessages | CapFragments | CapCachedStore | CapSenderHeader
+
+// Has returns true if every capability of other is in the set
+func (capabilities Capability) Has(other Capability) bool {
+	return capabilities&other == other
+}
+
+// Names returns the names of the capabilities of the set that this build knows
+func (capabilities Capability) Names() []string {
+	var names []string
+	for _, known := range capabilityNames {
+		if capabilities.Has(known.capability) {
+			names = append(names, known.name)
+		}
+	}
+	return names
+}
+
+func (capabilities Capability) String() string {
+	return strings.Join(capabilities.Names(), ",")
+}
+
+// Hello is the payload of PING and PONG messages, describing the sender
+type Hello struct {
+	Version      int
+	Capabilities Capability
+}
+
+// newHelloPayload returns the payload advertising the version and capabilities of the contact
+func newHelloPayload(contact Contact) []byte {
+	payload, _ := json.Marshal(Hello{Version: contact.Version, Capabilities: contact.Capabilities})
+	return payload
+}
+
+// withSender returns the sender of the message with the version and capabilities it
+// advertised, in the Hello of PING and PONG or in the header of the other messages.
+// Older peers advertise nothing and keep version 0
+func withSender(msg Message) Contact {
+	if msg.Type == PING || msg.Type == PONG {
+		return withHello(msg)
+	}
+	sender := msg.From
+	if msg.Version > 0 {
+		sender.Version = msg.Version
+		sender.Capabilities = msg.Capabilities
+	}
+	return sender
+}
+
+// withHello returns the sender of the PING or PONG message with the version and
+// capabilities it advertised. Older peers advertise nothing and keep version 0
+func withHello(msg Message) Contact {
+	sender := msg.From
+	var hello Hello
+	if len(msg.Payload) == 0 || json.Unmarshal(msg.Payload, &hello) != nil {
+		return sender
+	}
+	sender.Version = hello.Version
+	sender.Capabilities = hello.Capabilities
+	return sender
+}
@@ -0,0 +1,147 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilityNegotiation(t *testing.T) {
+	t.Run("PING and PONG advertise the version and capabilities", func(t *testing.T) {
+		sim := NewSimulatedNetwork()
+		nodeA := NewTestKademliaNode("nodeA", sim, DefaultConfig())
+		nodeB := NewTestKademliaNode("nodeB", sim, DefaultConfig())
+
+		require.NoError(t, nodeA.SendPing(&nodeB.Self))
+
+		for _, pair := range [][2]*Kademlia{{nodeA, nodeB}, {nodeB, nodeA}} {
+			contact, ok := pair[0].RoutingTable.GetContact(pair[1].Self.ID)
+			require.True(t, ok)
+			assert.Equal(t, ProtocolVersion, contact.Version)
+			assert.True(t, contact.Supports(CapBinaryCodec))
+		}
+	})
+
+	t.Run("Older peers advertise nothing", func(t *testing.T) {
+		old := NewContact(NewRandomKademliaID(), "old")
+		contact := withHello(Message{Type: PING, From: old})
+		assert.Equal(t, 0, contact.Version)
+		assert.False(t, contact.Supports(CapBinaryCodec))
+	})
+
+	t.Run("Other messages keep what the peer advertised", func(t *testing.T) {
+		routingTable := NewRoutingTable(NewContact(NewRandomKademliaID(), "me"))
+		peer := NewContact(NewRandomKademliaID(), "peer")
+		peer.Version, peer.Capabilities = ProtocolVersion, CapBinaryCodec
+		routingTable.AddContact(peer)
+		routingTable.AddContact(NewContact(peer.ID, "peer"))
+
+		contact, ok := routingTable.GetContact(peer.ID)
+		require.True(t, ok)
+		assert.Equal(t, ProtocolVersion, contact.Version)
+		assert.Equal(t, []string{"binary-codec"}, routingTable.Snapshot().Buckets[0].Contacts[0].Capabilities)
+	})
+
+	t.Run("Capabilities are not sent as part of contacts", func(t *testing.T) {
+		peer := NewContact(NewRandomKademliaID(), "peer")
+		peer.Version, peer.Capabilities = ProtocolVersion, CapBinaryCodec
+		data, err := json.Marshal([]Contact{peer})
+		require.NoError(t, err)
+
+		var contacts []Contact
+		require.NoError(t, json.Unmarshal(data, &contacts))
+		assert.Equal(t, 0, contacts[0].Version)
+	})
+
+	t.Run("The binary codec is only used with peers that support it", func(t *testing.T) {
+		peer := NewContact(NewRandomKademliaID(), "peer")
+		assert.Equal(t, JSONCodec{}, codecFor(BinaryCodec{}, peer))
+		peer.Capabilities = CapBinaryCodec
+		assert.Equal(t, JSONCodec{}, codecFor(BinaryCodec{}, peer), "Peers decoding only version 1 should get JSON")
+		peer.Capabilities = CapBinaryCodec | CapSignedMessages
+		assert.Equal(t, BinaryCodec{}, codecFor(BinaryCodec{}, peer))
+		assert.Equal(t, JSONCodec{}, codecFor(JSONCodec{}, peer))
+	})
+}
+
+// TestOlderPeerOverUDP checks that a node preferring the binary codec talks JSON
+// to a peer of an older build, which only decodes JSON and sends no version
+func TestOlderPeerOverUDP(t *testing.T) {
+	config := DefaultConfig()
+	config.Codec = BinaryCodecName
+	config.RPCTimeout = time.Second
+	node, err := NewKademliaNode("127.0.0.1", 8211, config)
+	require.NoError(t, err)
+	defer node.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	old := NewContact(NewRandomKademliaID(), conn.LocalAddr().String())
+
+	received := make(chan []byte, 2)
+	go func() {
+		buffer := make([]byte, 20480)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			received <- append([]byte{}, buffer[:n]...)
+			var msg Message
+			if json.Unmarshal(buffer[:n], &msg) != nil {
+				continue
+			}
+			// Answer like an older build, with an empty PONG
+			pong, _ := json.Marshal(Message{Type: PONG, From: old, To: msg.From, RPCID: msg.RPCID})
+			conn.WriteToUDP(pong, from)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, node.SendPing(&old))
+		data := <-received
+		assert.Equal(t, byte('{'), data[0], "Messages to an older peer should be JSON")
+	}
+	contact, ok := node.RoutingTable.GetContact(old.ID)
+	require.True(t, ok)
+	assert.Equal(t, 0, contact.Version)
+}
+
+// TestSenderHeaderOverUDP checks that nodes which only found each other through
+// lookups learn the version and capabilities of each other
+func TestSenderHeaderOverUDP(t *testing.T) {
+	config := DefaultConfig()
+	config.Codec = BinaryCodecName
+	nodes := joinedUDPNodes(t, config, 8241, 3)
+	nodeB, nodeC := nodes[1], nodes[2]
+
+	for _, pair := range [][2]*Kademlia{{nodeB, nodeC}, {nodeC, nodeB}} {
+		contact, ok := pair[0].RoutingTable.GetContact(pair[1].Self.ID)
+		require.True(t, ok, "Nodes joining through the same bootstrap node should find each other")
+		assert.Equal(t, ProtocolVersion, contact.Version)
+		assert.Equal(t, supportedCapabilities, contact.Capabilities)
+	}
+}
+
+// joinedUDPNodes starts n nodes on the ports from port, the first one being the
+// bootstrap node the others ping and join the network through one after the other
+func joinedUDPNodes(t *testing.T, config Config, port int, n int) []*Kademlia {
+	config.RPCTimeout = time.Second
+	var nodes []*Kademlia
+	for i := 0; i < n; i++ {
+		node, err := NewKademliaNode("127.0.0.1", port+i, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { node.Close() })
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes[1:] {
+		require.NoError(t, node.SendPing(&nodes[0].Self))
+		node.JoinNetwork(&nodes[0].Self)
+	}
+	return nodes
+}
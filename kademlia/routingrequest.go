@@ -1,10 +1,24 @@
 package kademlia
 
+import "time"
+
 type rtType int
 
 const (
 	AddContact rtType = iota
 	FindClosestContacts
+	ResolvePing
+	BucketCount
+	BucketIndex
+	RefreshTarget
+	Touch
+	IdleBuckets
+	RemoveContact
+	ReportFailure
+	AllContacts
+	Stats
+	Snapshot
+	GetContact
 )
 
 type RoutingRequest struct {
@@ -12,5 +26,7 @@ type RoutingRequest struct {
 	contact     Contact
 	target      *KademliaID
 	count       int
+	alive       bool
+	since       time.Time
 	responseCh  chan interface{}
 }
@@ -1,27 +1,63 @@
 package kademlia
 
+import "time"
+
+// bucketSize is the default number of contacts in a bucket, k
 const bucketSize = 20
 
 // RoutingTable definition
-// keeps a refrence contact of me and an array of buckets
+// keeps a refrence contact of me and the leaves of the routing tree.
+// The leaves are buckets ordered from the one furthest away from me
+// to the one containing my own ID.
+// It also counts the consecutive failures of every contact and
+// limits the number of contacts sharing an IP address or subnet
 type RoutingTable struct {
-	me      Contact
-	buckets [IDLength * 8]*bucket
+	me          Contact
+	k           int
+	b           int
+	maxFailures int
+	limits      diversityLimits
+	buckets     []*bucket
+	failures    map[KademliaID]int
+	stats       RoutingTableStats
 
 	ops chan RoutingRequest
 }
 
 // NewRoutingTable returns a new instance of a RoutingTable
+// using the default bucket size and the branching factor b = 1
 func NewRoutingTable(me Contact) *RoutingTable {
+	return NewRoutingTableWithConfig(me, DefaultConfig())
+}
+
+// NewRoutingTableWithBranching returns a new instance of a RoutingTable where
+// buckets not containing our own ID are split as long as their depth is not
+// a multiple of b (see section 4.2 of the Kademlia paper)
+func NewRoutingTableWithBranching(me Contact, b int) *RoutingTable {
+	config := DefaultConfig()
+	config.B = b
+	return NewRoutingTableWithConfig(me, config)
+}
+
+// NewRoutingTableWithConfig returns a new instance of a RoutingTable using
+// the bucket size K, the branching factor B and the diversity limits of the config
+func NewRoutingTableWithConfig(me Contact, config Config) *RoutingTable {
+	config = config.withDefaults()
 	routingTable := &RoutingTable{
-		me:  me,
-		ops: make(chan RoutingRequest),
-	}
-	for i := 0; i < IDLength*8; i++ {
-		routingTable.buckets[i] = newBucket()
+		me:          me,
+		k:           config.K,
+		b:           config.B,
+		maxFailures: config.MaxFailures,
+		limits: diversityLimits{
+			ipInBucket:     config.MaxPerIPInBucket,
+			subnetInBucket: config.MaxPerSubnetInBucket,
+			ipInTable:      config.MaxPerIPInTable,
+			subnetInTable:  config.MaxPerSubnetInTable,
+		},
+		buckets:  []*bucket{newBucket(config.K)},
+		failures: make(map[KademliaID]int),
+		ops:      make(chan RoutingRequest),
 	}
-	// routingTable.me = me
-	// return routingTable
 	go routingTable.run()
 	return routingTable
 }
@@ -30,8 +66,18 @@ func (routingTable *RoutingTable) run() {
 	for req := range routingTable.ops {
 		switch req.requestType {
 		case AddContact:
+			delete(routingTable.failures, *req.contact.ID)
+			leastRecentlySeen := routingTable.addContactInternal(req.contact)
+			if req.responseCh != nil {
+				req.responseCh <- leastRecentlySeen
+			}
+
+		case ResolvePing:
 			idx := routingTable.getBucketIndex(req.contact.ID)
-			routingTable.buckets[idx].AddContact(req.contact)
+			routingTable.buckets[idx].ResolvePing(req.contact, req.alive)
+			if !req.alive {
+				delete(routingTable.failures, *req.contact.ID)
+			}
 			if req.responseCh != nil {
 				req.responseCh <- true
 			}
@@ -39,47 +85,94 @@ func (routingTable *RoutingTable) run() {
 		case FindClosestContacts:
 			contacts := routingTable.findClosestContactsInternal(req.target, req.count)
 			req.responseCh <- contacts
+
+		case BucketCount:
+			req.responseCh <- len(routingTable.buckets)
+
+		case BucketIndex:
+			req.responseCh <- routingTable.getBucketIndex(req.target)
+
+		case RefreshTarget:
+			var target *KademliaID
+			if req.count >= 0 && req.count < len(routingTable.buckets) {
+				target = routingTable.buckets[req.count].randomID()
+			}
+			req.responseCh <- target
+
+		case Touch:
+			routingTable.buckets[routingTable.getBucketIndex(req.target)].touch()
+
+		case IdleBuckets:
+			var targets []*KademliaID
+			for _, bucket := range routingTable.buckets {
+				if bucket.idleSince(req.since) {
+					targets = append(targets, bucket.randomID())
+				}
+			}
+			req.responseCh <- targets
+
+		case RemoveContact:
+			req.responseCh <- routingTable.removeContactInternal(req.contact.ID)
+
+		case ReportFailure:
+			// Contacts that are not in a bucket are not counted, they would never be forgotten
+			removed := false
+			if routingTable.findContactInternal(req.contact.ID) != nil {
+				routingTable.failures[*req.contact.ID]++
+				if routingTable.failures[*req.contact.ID] >= routingTable.maxFailures {
+					removed = routingTable.removeContactInternal(req.contact.ID)
+				}
+			}
+			req.responseCh <- removed
+
+		case AllContacts:
+			var contacts []Contact
+			for _, bucket := range routingTable.buckets {
+				contacts = append(contacts, bucket.GetContactAndCalcDistance(routingTable.me.ID)...)
+			}
+			req.responseCh <- contacts
+
+		case Stats:
+			req.responseCh <- routingTable.statsInternal()
+
+		case Snapshot:
+			req.responseCh <- routingTable.snapshotInternal()
+
+		case GetContact:
+			req.responseCh <- routingTable.findContactInternal(req.target)
 		}
 	}
 }
 
-// AddContact add a new contact to the correct Bucket
-func (routingTable *RoutingTable) AddContact(contact Contact) {
-	// bucketIndex := routingTable.getBucketIndex(contact.ID)
-	// bucket := routingTable.buckets[bucketIndex]
-	// bucket.AddContact(contact)
+// AddContact add a new contact to the correct Bucket, splitting it first if it is full
+// and allowed to split. If the Bucket is full the least-recently seen contact is returned,
+// it should be pinged and the result reported through ResolvePing
+func (routingTable *RoutingTable) AddContact(contact Contact) *Contact {
+	respCh := make(chan interface{})
 	routingTable.ops <- RoutingRequest{
 		requestType: AddContact,
 		contact:     contact,
+		responseCh:  respCh,
 	}
+	return (<-respCh).(*Contact)
+}
+
+// ResolvePing reports whether the least-recently seen contact returned by
+// AddContact answered its ping. A dead contact is replaced by the most
+// recently seen contact of the Bucket's replacement cache
+func (routingTable *RoutingTable) ResolvePing(contact Contact, alive bool) {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: ResolvePing,
+		contact:     contact,
+		alive:       alive,
+		responseCh:  respCh,
+	}
+	<-respCh
 }
 
 // FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
 func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
-	// var candidates ContactCandidates
-	// bucketIndex := routingTable.getBucketIndex(target)
-	// bucket := routingTable.buckets[bucketIndex]
-
-	// candidates.Append(bucket.GetContactAndCalcDistance(target))
-
-	// for i := 1; (bucketIndex-i >= 0 || bucketIndex+i < IDLength*8) && candidates.Len() < count; i++ {
-	// 	if bucketIndex-i >= 0 {
-	// 		bucket = routingTable.buckets[bucketIndex-i]
-	// 		candidates.Append(bucket.GetContactAndCalcDistance(target))
-	// 	}
-	// 	if bucketIndex+i < IDLength*8 {
-	// 		bucket = routingTable.buckets[bucketIndex+i]
-	// 		candidates.Append(bucket.GetContactAndCalcDistance(target))
-	// 	}
-	// }
-
-	// candidates.Sort()
-
-	// if count > candidates.Len() {
-	// 	count = candidates.Len()
-	// }
-
-	// return candidates.GetContacts(count)
 	respCh := make(chan interface{})
 	routingTable.ops <- RoutingRequest{
 		requestType: FindClosestContacts,
@@ -91,22 +184,192 @@ func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count
 	return contacts
 }
 
-func (routingTable *RoutingTable) findClosestContactsInternal(target *KademliaID, count int) []Contact {
-	var candidates ContactCandidates
-	bucketIndex := routingTable.getBucketIndex(target)
-	bucket := routingTable.buckets[bucketIndex]
+// BucketCount returns the number of buckets (leaves of the routing tree)
+func (routingTable *RoutingTable) BucketCount() int {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: BucketCount,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(int)
+}
+
+// BucketIndex returns the index of the bucket covering the id
+func (routingTable *RoutingTable) BucketIndex(id *KademliaID) int {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: BucketIndex,
+		target:      id,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(int)
+}
 
-	candidates.Append(bucket.GetContactAndCalcDistance(target))
+// RefreshTarget returns a random ID in the range of the bucket at index idx
+// to look up when refreshing it, or nil if there is no such bucket
+func (routingTable *RoutingTable) RefreshTarget(idx int) *KademliaID {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: RefreshTarget,
+		count:       idx,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(*KademliaID)
+}
 
-	for i := 1; (bucketIndex-i >= 0 || bucketIndex+i < IDLength*8) && candidates.Len() < count; i++ {
-		if bucketIndex-i >= 0 {
-			bucket = routingTable.buckets[bucketIndex-i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
-		}
-		if bucketIndex+i < IDLength*8 {
-			bucket = routingTable.buckets[bucketIndex+i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
+// Touch records a lookup of the id as activity in the bucket covering it
+func (routingTable *RoutingTable) Touch(id *KademliaID) {
+	routingTable.ops <- RoutingRequest{
+		requestType: Touch,
+		target:      id,
+	}
+}
+
+// IdleBuckets returns a random ID in the range of every bucket
+// without any activity since the given time
+func (routingTable *RoutingTable) IdleBuckets(since time.Time) []*KademliaID {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: IdleBuckets,
+		since:       since,
+		responseCh:  respCh,
+	}
+	return (<-respCh).([]*KademliaID)
+}
+
+// RemoveContact removes the contact from the routing table, its place is taken by
+// a contact of the Bucket's replacement cache. It returns false if the contact was unknown
+func (routingTable *RoutingTable) RemoveContact(contact Contact) bool {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: RemoveContact,
+		contact:     contact,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(bool)
+}
+
+// ReportFailure records that the contact did not answer an RPC. After MaxFailures
+// consecutive failures the contact is removed and true is returned.
+// Any message received from the contact resets its count through AddContact
+func (routingTable *RoutingTable) ReportFailure(contact Contact) bool {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: ReportFailure,
+		contact:     contact,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(bool)
+}
+
+// AllContacts returns every contact of the routing table
+func (routingTable *RoutingTable) AllContacts() []Contact {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: AllContacts,
+		responseCh:  respCh,
+	}
+	return (<-respCh).([]Contact)
+}
+
+// GetContact returns the contact of the routing table with the given ID, false if it is unknown
+func (routingTable *RoutingTable) GetContact(id *KademliaID) (Contact, bool) {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: GetContact,
+		target:      id,
+		responseCh:  respCh,
+	}
+	contact := (<-respCh).(*Contact)
+	if contact == nil {
+		return Contact{}, false
+	}
+	return *contact, true
+}
+
+// Stats returns the number of contacts and buckets and how many contacts
+// were rejected by the IP address and subnet limits
+func (routingTable *RoutingTable) Stats() RoutingTableStats {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: Stats,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(RoutingTableStats)
+}
+
+func (routingTable *RoutingTable) statsInternal() RoutingTableStats {
+	stats := routingTable.stats
+	stats.Buckets = len(routingTable.buckets)
+	for _, bucket := range routingTable.buckets {
+		stats.Contacts += bucket.Len()
+	}
+	return stats
+}
+
+// findContactInternal returns the contact of a bucket with the given ID, nil if there is none
+func (routingTable *RoutingTable) findContactInternal(id *KademliaID) *Contact {
+	element := findElement(routingTable.buckets[routingTable.getBucketIndex(id)].list, id)
+	if element == nil {
+		return nil
+	}
+	contact := element.Value.(Contact)
+	return &contact
+}
+
+func (routingTable *RoutingTable) removeContactInternal(id *KademliaID) bool {
+	delete(routingTable.failures, *id)
+	return routingTable.buckets[routingTable.getBucketIndex(id)].RemoveContact(id)
+}
+
+func (routingTable *RoutingTable) addContactInternal(contact Contact) *Contact {
+	if contact.ID.Equals(routingTable.me.ID) {
+		return nil
+	}
+
+	for {
+		idx := routingTable.getBucketIndex(contact.ID)
+		bucket := routingTable.buckets[idx]
+		if bucket.Len() < routingTable.k || bucket.hasContact(contact.ID) || !routingTable.canSplit(bucket) {
+			if !routingTable.admits(contact, bucket) {
+				return nil
+			}
+			return bucket.AddContact(contact)
 		}
+		routingTable.splitBucket(idx)
+	}
+}
+
+// canSplit returns true if the bucket covers my own ID, or if
+// its depth is not a multiple of the branching factor b
+func (routingTable *RoutingTable) canSplit(bucket *bucket) bool {
+	if bucket.depth >= IDLength*8 {
+		return false
+	}
+	return bucket.contains(routingTable.me.ID) || bucket.depth%routingTable.b != 0
+}
+
+// splitBucket replaces the bucket at index idx by its two halves,
+// the half furthest away from me comes first
+func (routingTable *RoutingTable) splitBucket(idx int) {
+	depth := routingTable.buckets[idx].depth
+	zero, one := routingTable.buckets[idx].split()
+	far, near := one, zero
+	if routingTable.me.ID.bit(depth) == 1 {
+		far, near = zero, one
+	}
+
+	buckets := make([]*bucket, 0, len(routingTable.buckets)+1)
+	buckets = append(buckets, routingTable.buckets[:idx]...)
+	buckets = append(buckets, far, near)
+	buckets = append(buckets, routingTable.buckets[idx+1:]...)
+	routingTable.buckets = buckets
+}
+
+func (routingTable *RoutingTable) findClosestContactsInternal(target *KademliaID, count int) []Contact {
+	var candidates ContactCandidates
+	for _, bucket := range routingTable.buckets {
+		candidates.Append(bucket.GetContactAndCalcDistance(target))
 	}
 
 	candidates.Sort()
@@ -118,16 +381,13 @@ func (routingTable *RoutingTable) findClosestContactsInternal(target *KademliaID
 	return candidates.GetContacts(count)
 }
 
-// getBucketIndex get the correct Bucket index for the KademliaID
+// getBucketIndex get the index of the Bucket covering the KademliaID
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
-	distance := id.CalcDistance(routingTable.me.ID)
-	for i := 0; i < IDLength; i++ {
-		for j := 0; j < 8; j++ {
-			if (distance[i]>>uint8(7-j))&0x1 != 0 {
-				return i*8 + j
-			}
+	for i, bucket := range routingTable.buckets {
+		if bucket.contains(id) {
+			return i
 		}
 	}
 
-	return IDLength*8 - 1
+	return len(routingTable.buckets) - 1
 }
@@ -1,15 +1,18 @@
 package kademlia
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
 
 // TestGetBucketIndex verifies that the bucket index is calculated correctly based on the distance.
 func TestGetBucketIndex(t *testing.T) {
-	// 1. Setup: Create a "me" contact with a zero-ID for easy distance calculation.
+	// 1. Setup: Create a "me" contact with a zero-ID for easy distance calculation,
+	// and split the routing tree until our own bucket is 9 bits deep.
 	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
 	rt := NewRoutingTable(me)
+	splitOwnBucket(rt, 9)
 
 	// 2. Test Cases: Define different target IDs and their expected bucket index.
 	testCases := []struct {
@@ -36,7 +39,7 @@ func TestGetBucketIndex(t *testing.T) {
 		{
 			name:     "ID identical to 'me' (distance is 0)",
 			targetID: NewKademliaID("0000000000000000000000000000000000000000"),
-			expected: 159, // Should fall in the last bucket
+			expected: 9, // Should fall in the last bucket, our own
 		},
 		{
 			name:     "A distant ID",
@@ -54,7 +57,7 @@ func TestGetBucketIndex(t *testing.T) {
 	// 3. Action and Assertion: Run through the test cases.
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			bucketIndex := rt.getBucketIndex(tc.targetID)
+			bucketIndex := rt.BucketIndex(tc.targetID)
 			if tc.shouldFail {
 				if bucketIndex == tc.expected {
 					t.Errorf("Expected bucket index to NOT be %d, but it was", tc.expected)
@@ -150,3 +153,309 @@ func getContactIDs(contacts []Contact) []string {
 	}
 	return ids
 }
+
+// idWithCommonPrefix returns an ID sharing exactly cpl leading bits with the zero ID,
+// made unique by n
+func idWithCommonPrefix(cpl int, n int) *KademliaID {
+	id := KademliaID{}
+	id[cpl/8] |= 0x80 >> uint(cpl%8)
+	id[IDLength-2] = byte(n >> 8)
+	id[IDLength-1] = byte(n)
+	return &id
+}
+
+// splitOwnBucket fills the routing table of the zero ID until the bucket
+// containing it is depth bits deep
+func splitOwnBucket(rt *RoutingTable, depth int) {
+	for level := 0; level < depth; level++ {
+		for i := 0; i < bucketSize; i++ {
+			rt.AddContact(NewContact(idWithCommonPrefix(level, i), "localhost:8001"))
+		}
+	}
+	rt.AddContact(NewContact(idWithCommonPrefix(depth, 0), "localhost:8001"))
+}
+
+// checkTree verifies the invariants of the routing tree: the buckets cover the
+// whole ID space without overlapping, each contact lies in the range of its
+// bucket and every bucket is the result of a split that was allowed
+func checkTree(t *testing.T, rt *RoutingTable) {
+	t.Helper()
+	// Synchronise with the routing table goroutine before reading its buckets
+	rt.BucketCount()
+
+	coverage := 0.0
+	for i, b := range rt.buckets {
+		coverage += 1 / float64(uint64(1)<<uint(b.depth))
+		if b.Len() > bucketSize {
+			t.Errorf("Bucket %d holds %d contacts, more than k", i, b.Len())
+		}
+		for _, c := range b.GetContactAndCalcDistance(rt.me.ID) {
+			if !b.contains(c.ID) {
+				t.Errorf("Contact %s is outside the range of bucket %d", c.ID, i)
+			}
+		}
+		if b.depth > 0 {
+			parent := &bucket{prefix: b.prefix, depth: b.depth - 1}
+			if !parent.contains(rt.me.ID) && parent.depth%rt.b == 0 {
+				t.Errorf("Bucket %d at depth %d comes from a split that b=%d does not allow", i, b.depth, rt.b)
+			}
+		}
+		for j := i + 1; j < len(rt.buckets); j++ {
+			if b.prefix.CalcDistance(rt.me.ID).Less(rt.buckets[j].prefix.CalcDistance(rt.me.ID)) {
+				t.Errorf("Bucket %d is closer to me than bucket %d", i, j)
+			}
+		}
+	}
+	if coverage != 1 {
+		t.Errorf("Buckets cover %f of the ID space, expected all of it", coverage)
+	}
+}
+
+// TestRoutingTreeSplitsOwnBucket verifies that with b = 1 only the bucket
+// containing our own ID is split when it is full.
+func TestRoutingTreeSplitsOwnBucket(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTable(me)
+
+	if rt.BucketCount() != 1 {
+		t.Fatalf("Expected a new table to have a single bucket, got %d", rt.BucketCount())
+	}
+
+	// Filling the far half does not split it, the extra contacts go to the replacement cache
+	for i := 0; i < 2*bucketSize; i++ {
+		rt.AddContact(NewContact(idWithCommonPrefix(0, i), "localhost:8001"))
+	}
+	if rt.BucketCount() != 2 {
+		t.Fatalf("Expected the root to be split once, got %d buckets", rt.BucketCount())
+	}
+	if n := len(rt.FindClosestContacts(me.ID, 4*bucketSize)); n != bucketSize {
+		t.Errorf("Expected the far bucket to hold %d contacts, got %d", bucketSize, n)
+	}
+
+	splitOwnBucket(rt, 5)
+	if rt.BucketCount() != 6 {
+		t.Errorf("Expected 6 buckets after splitting down to depth 5, got %d", rt.BucketCount())
+	}
+	checkTree(t, rt)
+}
+
+// TestRoutingTreeBranching verifies that buckets far away from our own ID are
+// split until their depth is a multiple of b, for several values of b.
+func TestRoutingTreeBranching(t *testing.T) {
+	for _, b := range []int{1, 2, 3, 4} {
+		t.Run(fmt.Sprintf("b=%d", b), func(t *testing.T) {
+			me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+			rt := NewRoutingTableWithBranching(me, b)
+
+			// Many contacts in the half of the ID space not containing our own ID
+			for i := 0; i < 2000; i++ {
+				id := NewRandomKademliaID()
+				id[0] |= 0x80
+				rt.AddContact(NewContact(id, "localhost:8001"))
+			}
+
+			far := 1 << uint(b-1)
+			if rt.BucketCount() != far+1 {
+				t.Errorf("Expected %d buckets in the far half and our own, got %d buckets", far, rt.BucketCount())
+			}
+			for i := 0; i < far; i++ {
+				if depth := rt.buckets[i].depth; depth != b {
+					t.Errorf("Expected far bucket %d at depth %d, got %d", i, b, depth)
+				}
+				if rt.buckets[i].Len() != bucketSize {
+					t.Errorf("Expected far bucket %d to be full, got %d contacts", i, rt.buckets[i].Len())
+				}
+			}
+			checkTree(t, rt)
+		})
+	}
+}
+
+// TestRoutingTreeRandom verifies the tree invariants for random IDs and several values of b.
+func TestRoutingTreeRandom(t *testing.T) {
+	for _, b := range []int{1, 2, 3, 5} {
+		t.Run(fmt.Sprintf("b=%d", b), func(t *testing.T) {
+			me := NewContact(NewRandomKademliaID(), "localhost:8000")
+			rt := NewRoutingTableWithBranching(me, b)
+			for i := 0; i < 3000; i++ {
+				rt.AddContact(NewContact(NewRandomKademliaID(), "localhost:8001"))
+			}
+			// Contacts close to our own ID force the own bucket to split deeper
+			for i := 0; i < 200; i++ {
+				id := *NewRandomKademliaID()
+				copy(id[:2], me.ID[:2])
+				rt.AddContact(NewContact(&id, "localhost:8001"))
+			}
+			checkTree(t, rt)
+
+			closest := rt.FindClosestContacts(me.ID, bucketSize)
+			for i := 1; i < len(closest); i++ {
+				if closest[i].Less(&closest[i-1]) {
+					t.Errorf("FindClosestContacts is not sorted by distance")
+				}
+			}
+		})
+	}
+}
+
+// TestReportFailure verifies that a contact is removed after MaxFailures
+// consecutive failures, and that hearing from it resets the count.
+func TestReportFailure(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	config := DefaultConfig()
+	config.MaxFailures = 2
+	rt := NewRoutingTableWithConfig(me, config)
+	contact := NewContact(NewKademliaID("8000000000000000000000000000000000000001"), "localhost:8001")
+	rt.AddContact(contact)
+
+	if rt.ReportFailure(contact) {
+		t.Fatal("Contact should not be removed after a single failure")
+	}
+	rt.AddContact(contact)
+	if rt.ReportFailure(contact) {
+		t.Fatal("Hearing from the contact should reset its failure count")
+	}
+	if !rt.ReportFailure(contact) {
+		t.Fatal("Contact should be removed after two consecutive failures")
+	}
+	if len(rt.FindClosestContacts(contact.ID, 1)) != 0 {
+		t.Errorf("Removed contact should no longer be in the routing table")
+	}
+}
+
+// TestReportFailureOfUnknownContact verifies that failures are only
+// counted for the contacts of the routing table, so the counts never pile up
+func TestReportFailureOfUnknownContact(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTableWithConfig(me, DefaultConfig())
+	for i := 0; i < 100; i++ {
+		if rt.ReportFailure(NewContact(NewRandomKademliaID(), "localhost:8001")) {
+			t.Fatal("A contact that is not in the routing table cannot be removed")
+		}
+	}
+	if rt.Stats().Contacts != 0 || len(rt.failures) != 0 {
+		t.Errorf("Expected no failure counted, got %d", len(rt.failures))
+	}
+}
+
+// TestRemoveContact verifies that a removed contact is replaced from the replacement cache.
+func TestRemoveContact(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTable(me)
+	for i := 0; i <= bucketSize; i++ {
+		rt.AddContact(NewContact(idWithCommonPrefix(0, i), "localhost:8001"))
+	}
+	replacement := idWithCommonPrefix(0, bucketSize)
+	if containsID(getContactIDs(rt.FindClosestContacts(me.ID, 2*bucketSize)), replacement.String()) {
+		t.Fatal("Expected the last contact to wait in the replacement cache")
+	}
+
+	if !rt.RemoveContact(NewContact(idWithCommonPrefix(0, 0), "localhost:8001")) {
+		t.Fatal("Expected the contact to be removed")
+	}
+	if rt.RemoveContact(NewContact(idWithCommonPrefix(0, 0), "localhost:8001")) {
+		t.Errorf("Removing an unknown contact should return false")
+	}
+	if !containsID(getContactIDs(rt.FindClosestContacts(me.ID, 2*bucketSize)), replacement.String()) {
+		t.Errorf("Expected the replacement to take the place of the removed contact")
+	}
+}
+
+// TestDiversityLimits verifies that contacts sharing an IP address or a subnet
+// are rejected once the limits of the bucket and of the table are reached.
+func TestDiversityLimits(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "10.0.0.1:8000")
+	config := DefaultConfig()
+	config.MaxPerIPInBucket = 2
+	config.MaxPerSubnetInBucket = 3
+	config.MaxPerIPInTable = 3
+	rt := NewRoutingTableWithConfig(me, config)
+
+	// All contacts fall in the bucket furthest away from me
+	addresses := []string{"10.0.1.1:8001", "10.0.1.1:8002", "10.0.1.1:8003", "10.0.1.2:8001", "10.0.1.3:8001"}
+	for i, address := range addresses {
+		rt.AddContact(NewContact(idWithCommonPrefix(0, i), address))
+	}
+	// Hearing again from a known contact is never rejected
+	rt.AddContact(NewContact(idWithCommonPrefix(0, 0), "10.0.1.1:8001"))
+
+	stats := rt.Stats()
+	if stats.Contacts != 3 {
+		t.Errorf("Expected 3 contacts, got %d", stats.Contacts)
+	}
+	if stats.RejectedIPInBucket != 1 || stats.RejectedSubnetInBucket != 1 {
+		t.Errorf("Expected one rejection per bucket limit, got %+v", stats)
+	}
+
+	// The limits of the table apply across buckets
+	config = DefaultConfig()
+	config.MaxPerIPInTable = 2
+	rt = NewRoutingTableWithConfig(me, config)
+	rt.AddContact(NewContact(idWithCommonPrefix(0, 0), "10.0.1.1:8001"))
+	rt.AddContact(NewContact(idWithCommonPrefix(1, 0), "10.0.1.1:8002"))
+	rt.AddContact(NewContact(idWithCommonPrefix(2, 0), "10.0.1.1:8003"))
+	rt.AddContact(NewContact(idWithCommonPrefix(3, 0), "[2001:db8::1]:8001"))
+	rt.AddContact(NewContact(idWithCommonPrefix(4, 0), "nodeA:8001"))
+	stats = rt.Stats()
+	if stats.RejectedIPInTable != 1 {
+		t.Errorf("Expected one rejection by the table limit, got %+v", stats)
+	}
+	if stats.Contacts != 4 {
+		t.Errorf("Expected the IPv6 and named contacts to be added, got %d contacts", stats.Contacts)
+	}
+}
+
+func TestNetworkOf(t *testing.T) {
+	testCases := []struct {
+		address string
+		ip      string
+		subnet  string
+		ok      bool
+	}{
+		{"192.168.1.42:8000", "192.168.1.42", "192.168.1.0", true},
+		{"[2001:db8:1:2:3::4]:8000", "2001:db8:1:2:3::4", "2001:db8:1:2::", true},
+		{"nodeA", "", "", false},
+		{"kademlia-node:8000", "", "", false},
+	}
+	for _, tc := range testCases {
+		ip, subnet, ok := networkOf(tc.address)
+		if ip != tc.ip || subnet != tc.subnet || ok != tc.ok {
+			t.Errorf("networkOf(%q) = %q, %q, %v, expected %q, %q, %v", tc.address, ip, subnet, ok, tc.ip, tc.subnet, tc.ok)
+		}
+	}
+}
+
+// TestSnapshot verifies that the snapshot lists every bucket with its contacts,
+// most recently seen first.
+func TestSnapshot(t *testing.T) {
+	me := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost:8000")
+	rt := NewRoutingTable(me)
+	splitOwnBucket(rt, 2)
+	rt.AddContact(NewContact(idWithCommonPrefix(1, 100), "localhost:8001"))
+	rt.AddContact(NewContact(idWithCommonPrefix(1, 0), "localhost:8001"))
+
+	snapshot := rt.Snapshot()
+	if snapshot.ID != me.ID.String() || len(snapshot.Buckets) != 3 {
+		t.Fatalf("Expected a snapshot of 3 buckets of %s, got %+v", me.ID, snapshot)
+	}
+	prefixes := []string{"1", "01", "00"}
+	for i, bucket := range snapshot.Buckets {
+		if bucket.Index != i || bucket.Prefix != prefixes[i] || bucket.Size != bucketSize {
+			t.Errorf("Unexpected bucket %d: %+v", i, bucket)
+		}
+	}
+
+	contacts := snapshot.Buckets[1].Contacts
+	if len(contacts) != bucketSize || contacts[0].ID != idWithCommonPrefix(1, 0).String() {
+		t.Fatalf("Expected a full bucket with the last contact seen first, got %+v", contacts)
+	}
+	if contacts[0].LastSeen.IsZero() || contacts[0].LastSeen.Before(contacts[len(contacts)-1].LastSeen) {
+		t.Errorf("Expected contacts ordered by last seen time")
+	}
+	if snapshot.Buckets[1].Fill() != 1 {
+		t.Errorf("Expected a fill of 1, got %f", snapshot.Buckets[1].Fill())
+	}
+	if snapshot.Buckets[1].Replacements != 1 {
+		t.Errorf("Expected the extra contact in the replacement cache, got %d", snapshot.Buckets[1].Replacements)
+	}
+}
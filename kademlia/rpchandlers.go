@@ -9,9 +9,19 @@ import (
 )
 
 func (kademlia *Kademlia) HandleMessage(msg Message, addr *net.UDPAddr) {
+	// Drop messages whose sender claims an ID that its key does not prove
+	if !kademlia.verifySender(msg) {
+		fmt.Printf("Dropping %s message with unverified sender ID %s\n", msg.Type, msg.From.ID)
+		return
+	}
+
 	// Update the sender's address in the Contact
-	msg.From.Address = addr.String()
-	kademlia.RoutingTable.AddContact(msg.From)
+	// (the simulated network delivers messages without an address)
+	if addr != nil {
+		msg.From.Address = addr.String()
+	}
+	msg.From = withSender(msg)
+	kademlia.updateRoutingTable(msg.From)
 
 	fmt.Printf("Received message of type %s from %s\n", msg.Type, msg.From.Address)
 	fmt.Printf("Message details: %+v\n", msg)
@@ -53,27 +63,34 @@ func (k *Kademlia) handleResponse(msg Message) {
 func (kademlia *Kademlia) handlePing(msg Message) {
 	fmt.Printf("Received PING from %s\n", msg.From.Address)
 	pong := NewPongMessage(kademlia.Self, msg.RPCID, msg.From)
-	kademlia.Network.SendMessage(msg.From.Address, pong)
+	kademlia.sendMessage(msg.From.Address, pong)
 }
 
 func (kademlia *Kademlia) handleStore(msg Message) {
 	fmt.Printf("Received STORE from %s\n", &msg.From)
-	var value string
-	err := json.Unmarshal(msg.Payload, &value)
-	if err != nil {
-		fmt.Println("Error unmarshaling value:", err)
-		return
+	// Primary replicas are sent as the value alone, cached copies as a StorePayload
+	var payload StorePayload
+	if err := json.Unmarshal(msg.Payload, &payload.Value); err != nil {
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			fmt.Println("Error unmarshaling value:", err)
+			return
+		}
 	}
+	value := payload.Value
 	hash := sha1.Sum([]byte(value))
 	key := NewKademliaID(hex.EncodeToString(hash[:]))
 	storeResult := true
-	kademlia.DataStore.Put(key.String(), value)
+	if payload.Cache {
+		kademlia.DataStore.PutCached(key.String(), value, min(payload.TTL, kademlia.Config.TTL))
+	} else {
+		kademlia.DataStore.Put(key.String(), value)
+	}
 	if err := recover(); err != nil {
 		storeResult = false
 	}
 
 	msgResponse := NewStoreResponseMessage(kademlia.Self, msg.RPCID, msg.From, storeResult)
-	kademlia.Network.SendMessage(msg.From.Address, msgResponse)
+	kademlia.sendMessage(msg.From.Address, msgResponse)
 
 	// Send STORE_RESPONSE back to the sender
 }
@@ -92,12 +109,12 @@ func (kademlia *Kademlia) handleFindValue(msg Message) {
 	//lookup
 	if exists {
 		response := NewFindValueResponseMessage(kademlia.Self, msg.RPCID, msg.From, dataItem, nil)
-		kademlia.Network.SendMessage(msg.From.Address, response)
+		kademlia.sendMessage(msg.From.Address, response)
 		return
 	} else {
-		closest := kademlia.RoutingTable.FindClosestContacts(targetID, bucketSize)
+		closest := kademlia.RoutingTable.FindClosestContacts(targetID, kademlia.Config.K)
 		response := NewFindValueResponseMessage(kademlia.Self, msg.RPCID, msg.From, "", closest)
-		kademlia.Network.SendMessage(msg.From.Address, response)
+		kademlia.sendMessage(msg.From.Address, response)
 		return
 	}
 
@@ -112,7 +129,7 @@ func (kademlia *Kademlia) handleFindNode(msg Message) {
 		return
 	}
 
-	closest := kademlia.RoutingTable.FindClosestContacts(targetID, bucketSize)
+	closest := kademlia.RoutingTable.FindClosestContacts(targetID, kademlia.Config.K)
 	response := ResponseFindNodeMessage(kademlia.Self, msg.RPCID, msg.From, closest)
-	kademlia.Network.SendMessage(msg.From.Address, response)
+	kademlia.sendMessage(msg.From.Address, response)
 }
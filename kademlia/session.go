@@ -0,0 +1,566 @@
+package kademlia
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// First bytes of the packets of the encrypted transport, they can start neither a JSON nor a binary message
+const (
+	handshakeInit  byte = 0xE1
+	handshakeReply byte = 0xE2
+	sealedMessage  byte = 0xE3
+)
+
+const (
+	handshakeTimeout   = 2 * time.Second  // Time to wait for the peer to answer a handshake
+	maxHandshakeAge    = time.Minute      // Handshakes started longer ago, or that far in the future, are dropped
+	sessionLifetime    = 10 * time.Minute // Time after which a new handshake is made with the peer
+	maxSessions        = 1024             // Sessions kept, the oldest are forgotten first
+	maxPendingSessions = 256              // Sessions started by peers that sent no message yet
+	replayWindow       = 64               // Counters behind the highest one received that are still accepted
+	redialInterval     = 10 * time.Second // Time between the handshakes started because a peer lost its session
+	maxRedials         = 1024             // Addresses whose last such handshake is remembered
+)
+
+// sealedHeaderSize is the size of the header of a sealed message:
+// kind, index of the session at the recipient, counter
+const sealedHeaderSize = 1 + 4 + 8
+
+var errUnknownSession = errors.New("unknown session")
+
+// sessionKey identifies the peer a session was made with
+type sessionKey struct {
+	address string
+	id      KademliaID
+}
+
+// session holds the keys agreed with a peer during a handshake. Messages are sealed with
+// AES-GCM, the nonce being a counter which the recipient checks against a replay window
+type session struct {
+	key         sessionKey
+	localIndex  uint32 // Index the peer puts in the messages it sends us
+	remoteIndex uint32 // Index we put in the messages we send to the peer
+	send        cipher.AEAD
+	receive     cipher.AEAD
+	created     time.Time
+
+	mu      sync.Mutex
+	counter uint64 // Last counter sent
+	highest uint64 // Highest counter received
+	window  uint64 // Bit i is set if the counter highest-i was received
+}
+
+// newSession derives the keys of both directions from the X25519 secret shared with the peer
+func newSession(key sessionKey, localIndex, remoteIndex uint32, shared, initiatorKey, responderKey []byte, initiator bool) (*session, error) {
+	prk := hmac.New(sha256.New, append(append([]byte{}, initiatorKey...), responderKey...))
+	prk.Write(shared)
+	secret := prk.Sum(nil)
+
+	initiatorAEAD, err := newAEAD(secret, "kademlia initiator")
+	if err != nil {
+		return nil, err
+	}
+	responderAEAD, err := newAEAD(secret, "kademlia responder")
+	if err != nil {
+		return nil, err
+	}
+
+	session := &session{key: key, localIndex: localIndex, remoteIndex: remoteIndex, created: time.Now()}
+	if initiator {
+		session.send, session.receive = initiatorAEAD, responderAEAD
+	} else {
+		session.send, session.receive = responderAEAD, initiatorAEAD
+	}
+	return session, nil
+}
+
+func newAEAD(secret []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonceFor(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// seal encrypts the encoded message, the header being authenticated too
+func (session *session) seal(data []byte) []byte {
+	session.mu.Lock()
+	session.counter++
+	counter := session.counter
+	session.mu.Unlock()
+
+	var header [sealedHeaderSize]byte
+	header[0] = sealedMessage
+	binary.BigEndian.PutUint32(header[1:], session.remoteIndex)
+	binary.BigEndian.PutUint64(header[5:], counter)
+
+	packet := make([]byte, 0, sealedHeaderSize+len(data)+session.send.Overhead())
+	packet = append(packet, header[:]...)
+	return session.send.Seal(packet, nonceFor(counter), data, header[:])
+}
+
+// open decrypts a sealed message, refusing the counters already received
+func (session *session) open(packet []byte) ([]byte, error) {
+	counter := binary.BigEndian.Uint64(packet[5:sealedHeaderSize])
+	data, err := session.receive.Open(nil, nonceFor(counter), packet[sealedHeaderSize:], packet[:sealedHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	if !session.accept(counter) {
+		return nil, fmt.Errorf("replayed message %d", counter)
+	}
+	return data, nil
+}
+
+// accept returns true the first time a counter within the replay window is seen
+func (session *session) accept(counter uint64) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	switch {
+	case counter == 0:
+		return false
+	case counter > session.highest:
+		if shift := counter - session.highest; shift < replayWindow {
+			session.window <<= shift
+		} else {
+			session.window = 0
+		}
+		session.window |= 1
+		session.highest = counter
+		return true
+	case session.highest-counter >= replayWindow:
+		return false
+	}
+
+	bit := uint64(1) << (session.highest - counter)
+	if session.window&bit != 0 {
+		return false
+	}
+	session.window |= bit
+	return true
+}
+
+func (session *session) expired(now time.Time) bool {
+	return now.Sub(session.created) > sessionLifetime
+}
+
+// dial is a handshake we started and are waiting the reply of
+type dial struct {
+	address   string
+	id        *KademliaID // ID the peer must have, nil if unknown
+	index     uint32
+	ephemeral *ecdh.PrivateKey
+	done      chan struct{}
+	session   *session
+	err       error
+}
+
+// sessionCache holds the sessions made with peers, by peer and by the index the peer sends.
+// A session started by a peer is pending until the first message of the peer proves that it
+// holds the keys, so that a replayed handshake cannot replace the session in use
+type sessionCache struct {
+	mu      sync.Mutex
+	byPeer  map[sessionKey]*session
+	byIndex map[uint32]*session
+	pending map[uint32]*session // Sessions started by peers that sent no message yet, by index
+	dials   map[uint32]*dial
+	dialing map[string]*dial     // Handshakes in progress by address
+	redials map[string]time.Time // Last handshake started because the peer at the address lost its session
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{
+		byPeer:  make(map[sessionKey]*session),
+		byIndex: make(map[uint32]*session),
+		pending: make(map[uint32]*session),
+		dials:   make(map[uint32]*dial),
+		dialing: make(map[string]*dial),
+		redials: make(map[string]time.Time),
+	}
+}
+
+// allowRedial returns true if a handshake may be made with the peer at the address, which
+// sent a message with a session we do not have. Such messages are not authenticated, so
+// this is done at most once per redialInterval for an address and for maxRedials addresses
+func (cache *sessionCache) allowRedial(address string, now time.Time) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if last, ok := cache.redials[address]; ok && now.Sub(last) < redialInterval {
+		return false
+	}
+	if len(cache.redials) >= maxRedials {
+		for address, last := range cache.redials {
+			if now.Sub(last) >= redialInterval {
+				delete(cache.redials, address)
+			}
+		}
+		if len(cache.redials) >= maxRedials {
+			return false
+		}
+	}
+	cache.redials[address] = now
+	return true
+}
+
+// get returns the newest session with the peer at the address, whatever its ID if it is nil
+func (cache *sessionCache) get(address string, id *KademliaID) *session {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if id != nil {
+		session := cache.byPeer[sessionKey{address, *id}]
+		if session == nil || session.expired(now) {
+			return nil
+		}
+		return session
+	}
+
+	var newest *session
+	for key, session := range cache.byPeer {
+		if key.address == address && !session.expired(now) && (newest == nil || session.created.After(newest.created)) {
+			newest = session
+		}
+	}
+	return newest
+}
+
+// put makes the session the one used with its peer. The session it replaces is kept
+// until it expires, for the messages already sent with it
+func (cache *sessionCache) put(session *session) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.store(session)
+}
+
+// store adds the session to the ones in use, cache.mu must be held
+func (cache *sessionCache) store(session *session) {
+	if len(cache.byIndex) >= maxSessions {
+		cache.evict()
+	}
+	cache.byPeer[session.key] = session
+	cache.byIndex[session.localIndex] = session
+}
+
+// putPending keeps the session started by a peer until its first message, forgetting
+// the oldest pending session if there are too many
+func (cache *sessionCache) putPending(session *session) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.pending) >= maxPendingSessions {
+		var oldestIndex uint32
+		var oldest time.Time
+		for index, pending := range cache.pending {
+			if oldest.IsZero() || pending.created.Before(oldest) {
+				oldestIndex, oldest = index, pending.created
+			}
+		}
+		delete(cache.pending, oldestIndex)
+	}
+	cache.pending[session.localIndex] = session
+}
+
+// confirm makes the pending session the one used with its peer, unless it was forgotten
+func (cache *sessionCache) confirm(session *session) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.pending[session.localIndex] != session {
+		return
+	}
+	delete(cache.pending, session.localIndex)
+	cache.store(session)
+}
+
+// evict forgets the expired sessions, or the oldest one if none expired
+func (cache *sessionCache) evict() {
+	now := time.Now()
+	var oldest *session
+	for index, session := range cache.byIndex {
+		if session.expired(now) {
+			cache.remove(index, session)
+		} else if oldest == nil || session.created.Before(oldest.created) {
+			oldest = session
+		}
+	}
+	if len(cache.byIndex) >= maxSessions && oldest != nil {
+		cache.remove(oldest.localIndex, oldest)
+	}
+}
+
+func (cache *sessionCache) remove(index uint32, session *session) {
+	delete(cache.byIndex, index)
+	if cache.byPeer[session.key] == session {
+		delete(cache.byPeer, session.key)
+	}
+}
+
+// open decrypts a sealed message received from the address
+func (cache *sessionCache) open(packet []byte, address string) ([]byte, error) {
+	if len(packet) < sealedHeaderSize {
+		return nil, errors.New("truncated sealed message")
+	}
+	index := binary.BigEndian.Uint32(packet[1:])
+	cache.mu.Lock()
+	session := cache.byIndex[index]
+	pending := session == nil
+	if pending {
+		session = cache.pending[index]
+	}
+	cache.mu.Unlock()
+	if session == nil || session.key.address != address {
+		return nil, errUnknownSession
+	}
+	data, err := session.open(packet)
+	if err == nil && pending {
+		cache.confirm(session)
+	}
+	return data, err
+}
+
+// newIndex returns a random index used by no session nor handshake, cache.mu must be held
+func (cache *sessionCache) newIndex() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		index := binary.BigEndian.Uint32(b[:])
+		if cache.byIndex[index] == nil && cache.pending[index] == nil && cache.dials[index] == nil && index != 0 {
+			return index
+		}
+	}
+}
+
+// handshakePacket starts a session, it is sent in the clear by both peers:
+//
+//	kind       1 byte, handshakeInit or handshakeReply
+//	index      4 bytes, index the sender must be sent in sealed messages
+//	peer index 4 bytes, index of the initiator in a reply, 0 otherwise
+//	time       8 bytes, Unix time in seconds when the packet was made
+//	id         20 bytes, node ID of the sender
+//	ephemeral  32 bytes, X25519 public key made for this handshake
+//	key        32 bytes, ed25519 public key of the sender
+//	signature  64 bytes, made with the ed25519 key
+//
+// The signature of a reply also covers the ephemeral key of the initiator. Inits are
+// only answered within maxHandshakeAge of their time
+type handshakePacket struct {
+	kind      byte
+	index     uint32
+	peerIndex uint32
+	time      int64
+	id        KademliaID
+	ephemeral []byte
+	publicKey ed25519.PublicKey
+	signature []byte
+}
+
+const handshakeSize = 1 + 4 + 4 + 8 + IDLength + 32 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+func (packet *handshakePacket) signedBytes(initiatorEphemeral []byte) []byte {
+	data := make([]byte, 0, handshakeSize+len(initiatorEphemeral))
+	data = append(data, packet.kind)
+	data = binary.BigEndian.AppendUint32(data, packet.index)
+	data = binary.BigEndian.AppendUint32(data, packet.peerIndex)
+	data = binary.BigEndian.AppendUint64(data, uint64(packet.time))
+	data = append(data, packet.id[:]...)
+	data = append(data, packet.ephemeral...)
+	data = append(data, packet.publicKey...)
+	return append(data, initiatorEphemeral...)
+}
+
+func (packet *handshakePacket) marshal() []byte {
+	return append(packet.signedBytes(nil), packet.signature...)
+}
+
+func parseHandshake(data []byte) (handshakePacket, error) {
+	var packet handshakePacket
+	if len(data) != handshakeSize {
+		return packet, fmt.Errorf("handshake of %d bytes", len(data))
+	}
+	packet.kind = data[0]
+	packet.index = binary.BigEndian.Uint32(data[1:])
+	packet.peerIndex = binary.BigEndian.Uint32(data[5:])
+	packet.time = int64(binary.BigEndian.Uint64(data[9:]))
+	off := 17
+	copy(packet.id[:], data[off:off+IDLength])
+	off += IDLength
+	packet.ephemeral = data[off : off+32]
+	off += 32
+	packet.publicKey = data[off : off+ed25519.PublicKeySize]
+	packet.signature = data[off+ed25519.PublicKeySize:]
+	return packet, nil
+}
+
+// handshake makes a session with the peer at the address, whose ID must be id if it
+// is not nil. Concurrent handshakes with the same address share the first one
+func (network *Network) handshake(addr *net.UDPAddr, id *KademliaID) (*session, error) {
+	if network.identity == nil {
+		return nil, errors.New("no key to sign the handshake with")
+	}
+	sessions := network.sessions
+	address := addr.String()
+
+	sessions.mu.Lock()
+	pending := sessions.dialing[address]
+	if pending == nil {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			sessions.mu.Unlock()
+			return nil, err
+		}
+		pending = &dial{address: address, id: id, index: sessions.newIndex(), ephemeral: ephemeral, done: make(chan struct{})}
+		sessions.dials[pending.index] = pending
+		sessions.dialing[address] = pending
+		sessions.mu.Unlock()
+
+		packet := network.initPacket(pending.index, ephemeral, time.Now())
+		if _, err := network.Conn.WriteToUDP(packet.marshal(), addr); err != nil {
+			network.finishDial(pending, nil, err)
+		}
+		time.AfterFunc(handshakeTimeout, func() {
+			network.finishDial(pending, nil, fmt.Errorf("handshake with %s timed out", address))
+		})
+	} else {
+		sessions.mu.Unlock()
+	}
+
+	<-pending.done
+	if pending.err == nil && id != nil && !pending.session.key.id.Equals(id) {
+		return nil, fmt.Errorf("node at %s is not %s", address, id)
+	}
+	return pending.session, pending.err
+}
+
+// initPacket returns the signed init of a handshake made at the time
+func (network *Network) initPacket(index uint32, ephemeral *ecdh.PrivateKey, now time.Time) handshakePacket {
+	packet := handshakePacket{
+		kind:      handshakeInit,
+		index:     index,
+		time:      now.Unix(),
+		id:        *network.Self.ID,
+		ephemeral: ephemeral.PublicKey().Bytes(),
+		publicKey: network.identity.Public().(ed25519.PublicKey),
+	}
+	packet.signature = ed25519.Sign(network.identity, packet.signedBytes(nil))
+	return packet
+}
+
+// finishDial ends the handshake with the session made or the error, unless it already ended
+func (network *Network) finishDial(pending *dial, session *session, err error) {
+	sessions := network.sessions
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if sessions.dials[pending.index] != pending {
+		return
+	}
+	delete(sessions.dials, pending.index)
+	delete(sessions.dialing, pending.address)
+	pending.session, pending.err = session, err
+	close(pending.done)
+}
+
+// handleHandshake answers the handshake started by a peer, or ends the one we started
+func (network *Network) handleHandshake(data []byte, addr *net.UDPAddr) error {
+	if network.identity == nil {
+		return errors.New("no key to sign the handshake with")
+	}
+	packet, err := parseHandshake(data)
+	if err != nil {
+		return err
+	}
+	peerEphemeral, err := ecdh.X25519().NewPublicKey(packet.ephemeral)
+	if err != nil {
+		return err
+	}
+
+	var pending *dial
+	var initiatorEphemeral []byte
+	switch packet.kind {
+	case handshakeInit:
+		if age := time.Since(time.Unix(packet.time, 0)); age > maxHandshakeAge || age < -maxHandshakeAge {
+			return fmt.Errorf("handshake made %v ago", age.Round(time.Second))
+		}
+	case handshakeReply:
+		network.sessions.mu.Lock()
+		pending = network.sessions.dials[packet.peerIndex]
+		network.sessions.mu.Unlock()
+		if pending == nil || pending.address != addr.String() {
+			return errors.New("reply to no handshake of ours")
+		}
+		initiatorEphemeral = pending.ephemeral.PublicKey().Bytes()
+	}
+	if !ed25519.Verify(packet.publicKey, packet.signedBytes(initiatorEphemeral), packet.signature) {
+		return errors.New("bad handshake signature")
+	}
+	if network.verifyKey != nil && !network.verifyKey(&packet.id, packet.publicKey) {
+		return fmt.Errorf("key of %s does not match its ID", packet.id)
+	}
+	key := sessionKey{address: addr.String(), id: packet.id}
+
+	if pending != nil {
+		shared, err := pending.ephemeral.ECDH(peerEphemeral)
+		if err != nil {
+			return err
+		}
+		session, err := newSession(key, pending.index, packet.index, shared, initiatorEphemeral, packet.ephemeral, true)
+		if err != nil {
+			return err
+		}
+		network.sessions.put(session)
+		network.finishDial(pending, session, nil)
+		return nil
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return err
+	}
+	network.sessions.mu.Lock()
+	index := network.sessions.newIndex()
+	network.sessions.mu.Unlock()
+	session, err := newSession(key, index, packet.index, shared, packet.ephemeral, ephemeral.PublicKey().Bytes(), false)
+	if err != nil {
+		return err
+	}
+	network.sessions.putPending(session)
+
+	reply := handshakePacket{
+		kind:      handshakeReply,
+		index:     index,
+		peerIndex: packet.index,
+		time:      time.Now().Unix(),
+		id:        *network.Self.ID,
+		ephemeral: ephemeral.PublicKey().Bytes(),
+		publicKey: network.identity.Public().(ed25519.PublicKey),
+	}
+	reply.signature = ed25519.Sign(network.identity, reply.signedBytes(packet.ephemeral))
+	_, err = network.Conn.WriteToUDP(reply.marshal(), addr)
+	return err
+}
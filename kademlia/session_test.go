@@ -0,0 +1,169 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sessionPair returns the two ends of a session, as made by a handshake
+func sessionPair(t *testing.T) (initiator, responder *session) {
+	shared := bytes.Repeat([]byte{1}, 32)
+	initiatorKey, responderKey := bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)
+	initiator, err := newSession(sessionKey{address: "responder"}, 1, 2, shared, initiatorKey, responderKey, true)
+	require.NoError(t, err)
+	responder, err = newSession(sessionKey{address: "initiator"}, 2, 1, shared, initiatorKey, responderKey, false)
+	require.NoError(t, err)
+	return initiator, responder
+}
+
+func TestSealedMessages(t *testing.T) {
+	initiator, responder := sessionPair(t)
+	msg := NewStoreMessage(NewContact(NewRandomKademliaID(), "a"), *NewRandomKademliaID(), NewContact(NewRandomKademliaID(), "b"), "secret value")
+	data, err := JSONCodec{}.Encode(msg)
+	require.NoError(t, err)
+
+	packet := initiator.seal(data)
+	assert.False(t, bytes.Contains(packet, []byte("secret")), "Values should not be readable on the wire")
+	assert.Equal(t, sealedMessage, packet[0])
+
+	opened, err := responder.open(packet)
+	require.NoError(t, err)
+	assert.Equal(t, data, opened)
+
+	t.Run("Replayed messages are dropped", func(t *testing.T) {
+		_, err := responder.open(packet)
+		assert.Error(t, err)
+	})
+
+	t.Run("Changed messages are dropped", func(t *testing.T) {
+		changed := initiator.seal(data)
+		changed[len(changed)-1] ^= 1
+		_, err := responder.open(changed)
+		assert.Error(t, err)
+	})
+
+	t.Run("Each direction has its own key", func(t *testing.T) {
+		_, err := initiator.open(initiator.seal(data))
+		assert.Error(t, err, "A peer should not accept its own messages")
+		_, err = initiator.open(responder.seal(data))
+		assert.NoError(t, err)
+	})
+}
+
+func TestReplayWindow(t *testing.T) {
+	var s session
+	for _, counter := range []uint64{1, 3, 2, 70, 10} {
+		assert.True(t, s.accept(counter), "Counter %d was never received", counter)
+	}
+	for _, counter := range []uint64{0, 1, 2, 3, 70} {
+		assert.False(t, s.accept(counter), "Counter %d should be refused", counter)
+	}
+	assert.True(t, s.accept(7), "Counters within the window should be accepted out of order")
+	assert.False(t, s.accept(6), "Counters too far behind the highest one should be refused")
+}
+
+func TestEncryptedNetwork(t *testing.T) {
+	config := DefaultConfig()
+	config.Encrypt = true
+	config.RPCTimeout = time.Second
+	nodeA, err := NewKademliaNode("127.0.0.1", 8221, config)
+	require.NoError(t, err)
+	defer nodeA.Close()
+	nodeB, err := NewKademliaNode("127.0.0.1", 8222, config)
+	require.NoError(t, err)
+	defer nodeB.Close()
+
+	plainConfig := DefaultConfig()
+	plainConfig.RPCTimeout = 500 * time.Millisecond
+	plain, err := NewKademliaNode("127.0.0.1", 8223, plainConfig)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	t.Run("Encrypted nodes store and find values", func(t *testing.T) {
+		ctx := context.Background()
+		value := "secret value"
+		key := KademliaID(sha1.Sum([]byte(value)))
+		require.NoError(t, nodeA.StoreContext(ctx, &nodeB.Self, value, key.String()))
+
+		_, found, err := nodeA.FindValueContext(ctx, &nodeB.Self, &key)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, value, *found)
+	})
+
+	t.Run("Plain nodes answer encrypted ones", func(t *testing.T) {
+		assert.NoError(t, nodeA.SendPing(&plain.Self))
+		assert.NotNil(t, plain.Network.(*Network).sessions.get(nodeA.Self.Address, nodeA.Self.ID))
+	})
+
+	t.Run("Messages in the clear are dropped by encrypted nodes", func(t *testing.T) {
+		assert.Error(t, plain.SendPing(&nodeB.Self))
+	})
+
+	t.Run("Handshakes check the ID of the peer", func(t *testing.T) {
+		impostor := Contact{ID: NewRandomKademliaID(), Address: nodeB.Self.Address}
+		assert.Error(t, nodeA.SendPing(&impostor))
+	})
+}
+
+func TestReplayedHandshake(t *testing.T) {
+	config := DefaultConfig()
+	config.Encrypt = true
+	config.RPCTimeout = time.Second
+	nodeA, err := NewKademliaNode("127.0.0.1", 8224, config)
+	require.NoError(t, err)
+	defer nodeA.Close()
+	nodeB, err := NewKademliaNode("127.0.0.1", 8225, config)
+	require.NoError(t, err)
+	defer nodeB.Close()
+
+	require.NoError(t, nodeA.SendPing(&nodeB.Self))
+	networkA, networkB := nodeA.Network.(*Network), nodeB.Network.(*Network)
+	session := networkB.sessions.get(nodeA.Self.Address, nodeA.Self.ID)
+	require.NotNil(t, session)
+	addrA := networkA.Conn.LocalAddr().(*net.UDPAddr)
+
+	t.Run("Replayed inits do not replace the session in use", func(t *testing.T) {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		init := networkA.initPacket(1, ephemeral, time.Now())
+		for i := 0; i < 2*maxPendingSessions; i++ {
+			require.NoError(t, networkB.handleHandshake(init.marshal(), addrA))
+		}
+
+		assert.Same(t, session, networkB.sessions.get(nodeA.Self.Address, nodeA.Self.ID))
+		assert.LessOrEqual(t, len(networkB.sessions.pending), maxPendingSessions)
+		assert.NoError(t, nodeA.SendPing(&nodeB.Self))
+	})
+
+	t.Run("Stale inits are dropped", func(t *testing.T) {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		init := networkA.initPacket(1, ephemeral, time.Now().Add(-2*maxHandshakeAge))
+		assert.Error(t, networkB.handleHandshake(init.marshal(), addrA))
+	})
+}
+
+func TestRedialsAreLimited(t *testing.T) {
+	cache := newSessionCache()
+	now := time.Now()
+	assert.True(t, cache.allowRedial("peer", now))
+	assert.False(t, cache.allowRedial("peer", now.Add(redialInterval/2)), "Peers should not be dialed again right away")
+	assert.True(t, cache.allowRedial("peer", now.Add(redialInterval)))
+
+	for i := 0; i < 2*maxRedials; i++ {
+		cache.allowRedial(fmt.Sprintf("peer%d", i), now)
+	}
+	assert.LessOrEqual(t, len(cache.redials), maxRedials)
+	assert.True(t, cache.allowRedial("other", now.Add(2*redialInterval)), "Old addresses should make room for new ones")
+}
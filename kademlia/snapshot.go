@@ -0,0 +1,96 @@
+package kademlia
+
+import (
+	"strings"
+	"time"
+)
+
+// RoutingTableSnapshot is a copy of the routing table at one point in time,
+// the buckets are ordered from the one furthest away from the node to its own
+type RoutingTableSnapshot struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Buckets []BucketSnapshot  `json:"buckets"`
+	Stats   RoutingTableStats `json:"stats"`
+}
+
+// BucketSnapshot describes one bucket, its contacts are ordered
+// from the most recently seen to the least recently seen
+type BucketSnapshot struct {
+	Index        int               `json:"index"`
+	Prefix       string            `json:"prefix"` // First depth bits of the IDs covered by the bucket
+	Size         int               `json:"size"`
+	Contacts     []ContactSnapshot `json:"contacts"`
+	Replacements int               `json:"replacements"`
+	LastActivity time.Time         `json:"lastActivity"`
+}
+
+// ContactSnapshot describes a contact of a bucket
+type ContactSnapshot struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"lastSeen"`
+	Failures int       `json:"failures"`
+	// Protocol version and capabilities advertised by the peer, 0 and none if unknown
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Fill returns the share of the bucket that is used, between 0 and 1
+func (bucket BucketSnapshot) Fill() float64 {
+	if bucket.Size == 0 {
+		return 0
+	}
+	return float64(len(bucket.Contacts)) / float64(bucket.Size)
+}
+
+// Snapshot returns a copy of the buckets of the routing table with
+// the last time each contact was seen
+func (routingTable *RoutingTable) Snapshot() RoutingTableSnapshot {
+	respCh := make(chan interface{})
+	routingTable.ops <- RoutingRequest{
+		requestType: Snapshot,
+		responseCh:  respCh,
+	}
+	return (<-respCh).(RoutingTableSnapshot)
+}
+
+func (routingTable *RoutingTable) snapshotInternal() RoutingTableSnapshot {
+	snapshot := RoutingTableSnapshot{
+		ID:      routingTable.me.ID.String(),
+		Address: routingTable.me.Address,
+		Stats:   routingTable.statsInternal(),
+	}
+	for i, bucket := range routingTable.buckets {
+		bucketSnapshot := BucketSnapshot{
+			Index:        i,
+			Prefix:       bucket.prefixString(),
+			Size:         bucket.size,
+			Contacts:     []ContactSnapshot{},
+			Replacements: bucket.replacements.Len(),
+			LastActivity: bucket.lastActivity,
+		}
+		for e := bucket.list.Front(); e != nil; e = e.Next() {
+			contact := e.Value.(Contact)
+			bucketSnapshot.Contacts = append(bucketSnapshot.Contacts, ContactSnapshot{
+				ID:           contact.ID.String(),
+				Address:      contact.Address,
+				LastSeen:     bucket.lastSeen[*contact.ID],
+				Failures:     routingTable.failures[*contact.ID],
+				Version:      contact.Version,
+				Capabilities: contact.Capabilities.Names(),
+			})
+		}
+		snapshot.Buckets = append(snapshot.Buckets, bucketSnapshot)
+	}
+	return snapshot
+}
+
+// prefixString returns the bits shared by every ID of the bucket, such as "0110"
+func (bucket *bucket) prefixString() string {
+	var builder strings.Builder
+	for i := 0; i < bucket.depth; i++ {
+		builder.WriteByte('0' + bucket.prefix.bit(i))
+	}
+	return builder.String()
+}
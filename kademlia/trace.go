@@ -0,0 +1,137 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// LookupTrace records the queries of a lookup, see WithLookupTrace
+type LookupTrace struct {
+	Target   string        `json:"target"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Found    bool          `json:"found"`    // A contact returned what the lookup looked for, such as the value
+	LocalHit bool          `json:"localHit"` // The value was in our own datastore, nothing was queried
+	Queries  []TraceQuery  `json:"queries"`
+	Rounds   []TraceRound  `json:"rounds"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// TraceQuery is one contact queried during a lookup. Contacts known before the
+// lookup are queried in round 1, contacts returned by a query of round n in round n+1
+type TraceQuery struct {
+	Round    int            `json:"round"`
+	ID       string         `json:"id"`
+	Address  string         `json:"address"`
+	RTT      time.Duration  `json:"rtt"`
+	Returned []TraceContact `json:"returned"`
+	Value    bool           `json:"value"`
+	Stale    bool           `json:"stale"` // The lookup stopped waiting on the contact
+	TimedOut bool           `json:"timedOut"`
+	Err      string         `json:"error,omitempty"`
+}
+
+// TraceContact is a contact returned by a query
+type TraceContact struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// TraceRound holds the distance to the target of the closest contact
+// known once the queries of the round were answered
+type TraceRound struct {
+	Round   int    `json:"round"`
+	Queries int    `json:"queries"`
+	Closest string `json:"closest"`
+}
+
+type traceKey struct{}
+
+// WithLookupTrace returns a context that makes the lookups using it record
+// their queries in the returned trace. The trace must only be read once the
+// lookup returned, and a trace records a single lookup
+func WithLookupTrace(ctx context.Context) (context.Context, *LookupTrace) {
+	trace := &LookupTrace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// traceFromContext returns the trace to record a lookup in, or nil
+func traceFromContext(ctx context.Context) *LookupTrace {
+	trace, _ := ctx.Value(traceKey{}).(*LookupTrace)
+	return trace
+}
+
+// start records the target of the lookup
+func (trace *LookupTrace) start(target *KademliaID) {
+	if trace == nil {
+		return
+	}
+	trace.Target = target.String()
+	trace.Start = time.Now()
+}
+
+// localHit records that the value was found in our own datastore
+func (trace *LookupTrace) localHit(target *KademliaID) {
+	if trace == nil {
+		return
+	}
+	trace.start(target)
+	trace.Found = true
+	trace.LocalHit = true
+}
+
+// query records a sent query and returns its index
+func (trace *LookupTrace) query(round int, contact Contact) int {
+	if trace == nil {
+		return -1
+	}
+	trace.Queries = append(trace.Queries, TraceQuery{Round: round, ID: contact.ID.String(), Address: contact.Address})
+	return len(trace.Queries) - 1
+}
+
+// stale records that the lookup stopped waiting on the query
+func (trace *LookupTrace) stale(idx int) {
+	if trace == nil {
+		return
+	}
+	trace.Queries[idx].Stale = true
+}
+
+// answer records the response of the query and the closest distance known after it
+func (trace *LookupTrace) answer(idx int, sent time.Time, resp LookupResponse, closest *KademliaID) {
+	if trace == nil {
+		return
+	}
+	query := &trace.Queries[idx]
+	query.RTT = time.Since(sent)
+	for _, contact := range resp.Contacts {
+		query.Returned = append(query.Returned, TraceContact{ID: contact.ID.String(), Address: contact.Address})
+	}
+	query.Value = resp.Value != nil
+	if resp.Err != nil {
+		query.Err = resp.Err.Error()
+		query.TimedOut = errors.Is(resp.Err, ErrRPCTimeout)
+	}
+
+	for len(trace.Rounds) < query.Round {
+		trace.Rounds = append(trace.Rounds, TraceRound{Round: len(trace.Rounds) + 1})
+	}
+	round := &trace.Rounds[query.Round-1]
+	round.Queries++
+	if closest != nil {
+		round.Closest = closest.String()
+	}
+}
+
+// end records the outcome of the lookup, found is true if it ended on what it looked for
+func (trace *LookupTrace) end(found bool, err error) {
+	if trace == nil {
+		return
+	}
+	trace.Duration = time.Since(trace.Start)
+	trace.Found = found
+	if err != nil {
+		trace.Err = err.Error()
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"d7024e/kademlia"
 	"d7024e/server"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 func main() {
@@ -13,7 +17,73 @@ func main() {
 	bootstrapAddress := os.Getenv("BOOTSTRAP_ADDRESS")
 
 	// TODO: REMOVE WHEN KADEMLIA IS LISTENING
-	serv := server.NewServer(server.DEFAULT_SOCKET, bootstrapAddress)
+	serv := server.NewServer(server.DEFAULT_SOCKET, bootstrapAddress, configFromEnv())
 	serv.Listen()
 
 }
+
+// configFromEnv reads the Kademlia parameters from environment variables,
+// any variable that is not set keeps its default value
+func configFromEnv() kademlia.Config {
+	config := kademlia.DefaultConfig()
+	config.K = intFromEnv("KADEMLIA_K", config.K)
+	config.Alpha = intFromEnv("KADEMLIA_ALPHA", config.Alpha)
+	config.B = intFromEnv("KADEMLIA_B", config.B)
+	config.RPCTimeout = durationFromEnv("KADEMLIA_RPC_TIMEOUT", config.RPCTimeout)
+	config.StaleTimeout = durationFromEnv("KADEMLIA_STALE_TIMEOUT", config.StaleTimeout)
+	config.TTL = durationFromEnv("KADEMLIA_TTL", config.TTL)
+	config.RefreshInterval = durationFromEnv("KADEMLIA_REFRESH_INTERVAL", config.RefreshInterval)
+	config.MaxFailures = intFromEnv("KADEMLIA_MAX_FAILURES", config.MaxFailures)
+	config.DataDir = os.Getenv("KADEMLIA_DATA_DIR")
+	config.VerifiableID = boolFromEnv("KADEMLIA_VERIFIABLE_ID", config.VerifiableID)
+	config.RequireKeys = boolFromEnv("KADEMLIA_REQUIRE_KEYS", config.RequireKeys)
+	config.NoLocalCopy = boolFromEnv("KADEMLIA_NO_LOCAL_COPY", config.NoLocalCopy)
+	if codec := os.Getenv("KADEMLIA_CODEC"); codec != "" {
+		config.Codec = codec
+	}
+	config.Encrypt = boolFromEnv("KADEMLIA_ENCRYPT", config.Encrypt)
+	config.MaxPerIPInBucket = intFromEnv("KADEMLIA_MAX_PER_IP_IN_BUCKET", config.MaxPerIPInBucket)
+	config.MaxPerSubnetInBucket = intFromEnv("KADEMLIA_MAX_PER_SUBNET_IN_BUCKET", config.MaxPerSubnetInBucket)
+	config.MaxPerIPInTable = intFromEnv("KADEMLIA_MAX_PER_IP_IN_TABLE", config.MaxPerIPInTable)
+	config.MaxPerSubnetInTable = intFromEnv("KADEMLIA_MAX_PER_SUBNET_IN_TABLE", config.MaxPerSubnetInTable)
+	return config
+}
+
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func boolFromEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return fallback
+	}
+	return parsed
+}
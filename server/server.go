@@ -2,8 +2,11 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"d7024e/kademlia"
 	"d7024e/storage"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -14,22 +17,64 @@ import (
 )
 
 const SEPARATING_STRING string = ":"
+const KEYS_SEPARATOR string = ","
 const DEFAULT_SOCKET string = "/tmp/svc.sock"
+const DEFAULT_PORT int = 8000
+
+// GetReply is the reply to a get request, Error is set if the value was not found
+type GetReply struct {
+	Key           string `json:"key,omitempty"`
+	Value         string `json:"value,omitempty"`
+	SourceID      string `json:"sourceId,omitempty"`
+	SourceAddress string `json:"sourceAddress,omitempty"`
+	Hops          int    `json:"hops,omitempty"`
+	Local         bool   `json:"local,omitempty"` // The node had the value in its own datastore
+	Error         string `json:"error,omitempty"`
+}
+
+// Builds the reply to a get request from the result of the lookup
+func newGetReply(result kademlia.ValueResult, err error) GetReply {
+	if err != nil {
+		return GetReply{Error: err.Error()}
+	}
+	getReply := GetReply{Value: *result.Value, Hops: result.Hops, Local: result.LocalHit}
+	if result.Source != nil {
+		getReply.SourceID = result.Source.ID.String()
+		getReply.SourceAddress = result.Source.Address
+	}
+	return getReply
+}
 
 type Server struct {
 	socketPath       string
 	exitNode         bool
+	exitCh           chan struct{}
 	mutExit          sync.RWMutex
+	ctx              context.Context // Canceled on exit, the requests in progress are abandoned
+	cancel           context.CancelFunc
 	storage          *storage.Storage
 	node             *kademlia.Kademlia
 	bootstrapAddress string
+	port             int
+	config           kademlia.Config
 }
 
-func NewServer(sockPath string, bootstrapAddress string) *Server {
+func NewServer(sockPath string, bootstrapAddress string, config kademlia.Config) *Server {
+	return NewServerWithPort(sockPath, bootstrapAddress, DEFAULT_PORT, config)
+}
+
+// Creates a server whose Kademlia node listens on the given UDP port
+func NewServerWithPort(sockPath string, bootstrapAddress string, port int, config kademlia.Config) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		socketPath:       sockPath,
 		exitNode:         false,
+		exitCh:           make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
 		bootstrapAddress: bootstrapAddress,
+		port:             port,
+		config:           config,
 	}
 }
 
@@ -45,17 +90,20 @@ func (s *Server) Listen() {
 		panic(err)
 	}
 
-	node, err := kademlia.NewKademliaNode("0.0.0.0", 8000)
+	node, err := kademlia.NewKademliaNode("0.0.0.0", s.port, s.config)
 	if err != nil {
 		log.Fatal("Failed to create Kademlia node:", err)
 	}
 	s.node = node
 	log.Printf("Node created with ID: %s on address %s", s.node.Self.ID, s.node.Self.Address)
 
-	if s.bootstrapAddress != "" {
+	if s.rejoin() {
+		log.Println("Rejoined the network through the contacts saved by the previous run.")
+	} else if s.bootstrapAddress != "" {
 		log.Printf("Attempting to join network via bootstrap node at %s", s.bootstrapAddress)
 
-		dummyContact := kademlia.NewContact(kademlia.NewRandomKademliaID(), s.bootstrapAddress)
+		// The ID of the bootstrap node is unknown until it answers, so that none is checked
+		dummyContact := kademlia.Contact{Address: s.bootstrapAddress}
 
 		// Ping the bootstrap node. We only care about success or failure.
 		var err error
@@ -64,7 +112,7 @@ func (s *Server) Listen() {
 		retryDelay := 2 * time.Second
 
 		for i := 0; i < maxRetries; i++ {
-			err = s.node.SendPing(&dummyContact)
+			err = s.node.SendPingContext(s.ctx, &dummyContact)
 			if err == nil {
 				log.Printf("Successfully pinged bootstrap node. ")
 				break
@@ -81,7 +129,7 @@ func (s *Server) Listen() {
 
 		// Find the full contact info from our routing table.
 		// Note: The bootstrap node should be the ONLY contact at this point.
-		contacts := s.node.RoutingTable.FindClosestContacts(dummyContact.ID, 1)
+		contacts := s.node.RoutingTable.FindClosestContacts(s.node.Self.ID, 1)
 		if len(contacts) < 1 {
 			log.Fatal("Bootstrap contact not found in routing table after successful ping.")
 		}
@@ -90,7 +138,9 @@ func (s *Server) Listen() {
 		log.Printf("Found bootstrap contact: %v", bootstrapContact)
 
 		// Now, join the network using the real, complete contact info.
-		s.node.JoinNetwork(&bootstrapContact)
+		if err := s.node.JoinNetworkContext(s.ctx, &bootstrapContact); err != nil {
+			log.Printf("Could not join the network: %v", err)
+		}
 	} else {
 		log.Println("No bootstrap address provided. Starting as a bootstrap node.")
 	}
@@ -122,58 +172,178 @@ func (s *Server) Listen() {
 		case err := <-errCh:
 			//TODO
 			fmt.Println("Error on connection:", err)
-		case <-time.After(3 * time.Second):
-
+		case <-s.exitCh:
 		}
 
 	}
 
 	ln.Close()
+	s.node.Close()
 	os.Remove(s.socketPath)
 }
 
-// Handle the connection
+// Pings the contacts saved in the data directory by a previous run
+// and joins the network through them if any of them answers
+func (s *Server) rejoin() bool {
+	alive, err := s.node.RestoreRoutingTable()
+	if err != nil {
+		log.Printf("Could not restore routing table: %v", err)
+		return false
+	}
+	if alive == 0 {
+		return false
+	}
+
+	log.Printf("%d saved contacts answered", alive)
+	contacts := s.node.RoutingTable.FindClosestContacts(s.node.Self.ID, 1)
+	if len(contacts) < 1 {
+		return false
+	}
+	if err := s.node.JoinNetworkContext(s.ctx, &contacts[0]); err != nil {
+		log.Printf("Could not join the network: %v", err)
+	}
+	return true
+}
+
+// Handle the connection. Requests are read in the background so that a client
+// disconnecting cancels the context of the request it is waiting on
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	reader := bufio.NewScanner(conn)
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
 
-	for reader.Scan() {
-		request := strings.TrimSpace(reader.Text())
+	requests := make(chan string)
+	go func() {
+		defer close(requests)
+		defer cancel()
+		reader := bufio.NewScanner(conn)
+		for reader.Scan() {
+			select {
+			case requests <- strings.TrimSpace(reader.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := reader.Err(); err != nil {
+			fmt.Println("Connection closed with error:", err)
+		} else {
+			fmt.Println("Client disconnected.")
+		}
+	}()
 
-		splitRequest := strings.Split(request, SEPARATING_STRING)
+	for request := range requests {
+		s.handleRequest(ctx, conn, request)
+	}
+}
 
-		if len(splitRequest) < 1 {
-			panic("Message shoud at least contain type of message")
-		}
+// Handle one request of a client, the work it starts is abandoned when the context is done
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, request string) {
+	splitRequest := strings.Split(request, SEPARATING_STRING)
 
-		switch splitRequest[0] {
-		case "exit":
-			s.mutExit.Lock()
+	if len(splitRequest) < 1 {
+		panic("Message shoud at least contain type of message")
+	}
+
+	switch splitRequest[0] {
+	case "exit":
+		s.mutExit.Lock()
+		if !s.exitNode {
 			s.exitNode = true
-			s.mutExit.Unlock()
-		case "ping":
-			reply(conn, "pong")
-		case "get":
-			// TODO: SEND BACK CONTACT
-			var response *string
-			_, response = s.node.LookupValue(splitRequest[1])
-			reply(conn, *response)
-		case "put":
-			// TODO: CHANGE IF VALUE NOT STORED WELL
-			var key string
-			key, _ = s.node.IterativeStore(splitRequest[1])
-			reply(conn, key)
-		}
-	}
-
-	if err := reader.Err(); err != nil {
-		fmt.Println("Connection closed with error:", err)
-	} else {
-		fmt.Println("Client disconnected.")
+			s.cancel()
+			close(s.exitCh)
+		}
+		s.mutExit.Unlock()
+	case "ping":
+		reply(conn, "pong")
+	case "get":
+		if len(splitRequest) < 2 {
+			replyJSON(conn, GetReply{Error: "get needs a key"})
+			return
+		}
+		if err := checkKey(splitRequest[1]); err != nil {
+			replyJSON(conn, GetReply{Key: splitRequest[1], Error: err.Error()})
+			return
+		}
+		result, err := s.node.LookupValueContext(ctx, splitRequest[1])
+		if ctx.Err() != nil {
+			fmt.Println("Lookup abandoned:", ctx.Err())
+			return
+		}
+		replyJSON(conn, newGetReply(result, err))
+	case "mget":
+		if len(splitRequest) < 2 {
+			replyJSON(conn, []GetReply{{Error: "mget needs at least one key"}})
+			return
+		}
+		keys := strings.Split(splitRequest[1], KEYS_SEPARATOR)
+		for _, key := range keys {
+			if err := checkKey(key); err != nil {
+				replyJSON(conn, []GetReply{{Key: key, Error: err.Error()}})
+				return
+			}
+		}
+		results := s.node.LookupValuesContext(ctx, keys)
+		if ctx.Err() != nil {
+			fmt.Println("Lookups abandoned:", ctx.Err())
+			return
+		}
+		getReplies := make([]GetReply, len(results))
+		for i, result := range results {
+			getReplies[i] = newGetReply(result.ValueResult, result.Err)
+			getReplies[i].Key = result.Key
+		}
+		replyJSON(conn, getReplies)
+	case "put":
+		result, err := s.node.IterativeStoreContext(ctx, splitRequest[1])
+		if err != nil {
+			fmt.Println("Store abandoned:", err)
+			return
+		}
+		replyJSON(conn, result)
+	case "routes":
+		replyJSON(conn, s.node.RoutingTable.Snapshot())
+	case "trace":
+		if len(splitRequest) < 2 {
+			replyJSON(conn, kademlia.LookupTrace{Err: "trace needs a key"})
+			return
+		}
+		if err := checkKey(splitRequest[1]); err != nil {
+			replyJSON(conn, kademlia.LookupTrace{Err: err.Error()})
+			return
+		}
+		traceCtx, trace := kademlia.WithLookupTrace(ctx)
+		_, err := s.node.LookupValueContext(traceCtx, splitRequest[1])
+		if ctx.Err() != nil {
+			fmt.Println("Lookup abandoned:", ctx.Err())
+			return
+		}
+		if err != nil && trace.Err == "" {
+			trace.Err = err.Error()
+		}
+		replyJSON(conn, trace)
 	}
 }
 
+// Returns an error if the key is not the hex encoding of a KademliaID
+func checkKey(key string) error {
+	if id, err := hex.DecodeString(key); err != nil || len(id) != kademlia.IDLength {
+		return fmt.Errorf("invalid key %q, expected %d hex encoded bytes", key, kademlia.IDLength)
+	}
+	return nil
+}
+
 // Sends a reply
 func reply(conn net.Conn, reply string) {
 	fmt.Fprintln(conn, reply)
 }
+
+// Sends a reply encoded as JSON on a single line
+func replyJSON(conn net.Conn, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Println("Error marshaling reply:", err)
+		reply(conn, "")
+		return
+	}
+	reply(conn, string(data))
+}
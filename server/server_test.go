@@ -1,6 +1,10 @@
 package server
 
 import (
+	"d7024e/kademlia"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -8,12 +12,14 @@ import (
 func TestReply(t *testing.T) {
 
 	socketPath := DEFAULT_SOCKET
-	server := NewServer(socketPath, "")
+	server := NewServerWithPort(socketPath, "", 8101, kademlia.DefaultConfig())
 
 	ch := make(chan string, 1)
+	done := make(chan struct{})
 
 	go func() {
 		server.Listen()
+		close(done)
 	}()
 
 	time.Sleep(100 * time.Millisecond)
@@ -32,11 +38,47 @@ func TestReply(t *testing.T) {
 		t.Fail()
 	}
 	SendMessage(conn, "exit")
+	<-done
+}
+
+func TestTrace(t *testing.T) {
+	socketPath := DEFAULT_SOCKET
+	server := NewServerWithPort(socketPath, "", 8106, kademlia.DefaultConfig())
+
+	done := make(chan struct{})
+	go func() {
+		server.Listen()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn := ConnectToServer(socketPath)
+	requests := map[string]string{
+		"trace":                     "",
+		"trace" + SEPARATING_STRING: "",
+		"trace" + SEPARATING_STRING + kademlia.NewRandomKademliaID().String(): kademlia.ErrValueNotFound.Error(),
+	}
+	for request, expected := range requests {
+		fmt.Fprintln(conn, request)
+		response := ListenToResponse(conn)
+
+		var trace kademlia.LookupTrace
+		if err := json.Unmarshal([]byte(response), &trace); err != nil {
+			t.Fatalf("Expected a JSON reply to %q, got %q: %v", request, response, err)
+		}
+		if trace.Err == "" || (expected != "" && trace.Err != expected) {
+			t.Errorf("Expected an error in the trace of %q, got %q", request, response)
+		}
+	}
+
+	SendMessage(conn, "exit")
+	<-done
 }
 
 func TestExitWorking(t *testing.T) {
 	socketPath := DEFAULT_SOCKET
-	server := NewServer(socketPath, "")
+	server := NewServerWithPort(socketPath, "", 8102, kademlia.DefaultConfig())
 
 	ch := make(chan string, 1)
 
@@ -58,3 +100,155 @@ func TestExitWorking(t *testing.T) {
 	}
 
 }
+
+func TestRoutes(t *testing.T) {
+	socketPath := DEFAULT_SOCKET
+	server := NewServerWithPort(socketPath, "", 8103, kademlia.DefaultConfig())
+
+	done := make(chan struct{})
+	go func() {
+		server.Listen()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn := ConnectToServer(socketPath)
+	SendMessage(conn, "routes")
+	response := ListenToResponse(conn)
+
+	var snapshot kademlia.RoutingTableSnapshot
+	if err := json.Unmarshal([]byte(response), &snapshot); err != nil {
+		t.Fatalf("Expected a JSON routing table, got %q: %v", response, err)
+	}
+	if snapshot.ID != server.node.Self.ID.String() || len(snapshot.Buckets) != 1 {
+		t.Errorf("Expected the single empty bucket of the node, got %+v", snapshot)
+	}
+
+	SendMessage(conn, "exit")
+	<-done
+}
+
+func TestGetNotFound(t *testing.T) {
+	socketPath := DEFAULT_SOCKET
+	server := NewServerWithPort(socketPath, "", 8104, kademlia.DefaultConfig())
+
+	done := make(chan struct{})
+	go func() {
+		server.Listen()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn := ConnectToServer(socketPath)
+	SendMessage(conn, "get"+SEPARATING_STRING+kademlia.NewRandomKademliaID().String())
+	response := ListenToResponse(conn)
+
+	var reply GetReply
+	if err := json.Unmarshal([]byte(response), &reply); err != nil {
+		t.Fatalf("Expected a JSON reply, got %q: %v", response, err)
+	}
+	if reply.Error != kademlia.ErrValueNotFound.Error() || reply.Value != "" {
+		t.Errorf("Expected a not found error, got %+v", reply)
+	}
+
+	for _, request := range []string{"get", "get" + SEPARATING_STRING, "get" + SEPARATING_STRING + "abc", "get" + SEPARATING_STRING + "zz"} {
+		fmt.Fprintln(conn, request)
+		response = ListenToResponse(conn)
+		reply = GetReply{}
+		if err := json.Unmarshal([]byte(response), &reply); err != nil || reply.Error == "" {
+			t.Errorf("Expected an error for %q, got %q", request, response)
+		}
+	}
+
+	SendMessage(conn, "exit")
+	<-done
+}
+
+func TestMultiGet(t *testing.T) {
+	socketPath := DEFAULT_SOCKET
+	server := NewServerWithPort(socketPath, "", 8105, kademlia.DefaultConfig())
+
+	done := make(chan struct{})
+	go func() {
+		server.Listen()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn := ConnectToServer(socketPath)
+	keys := []string{kademlia.NewRandomKademliaID().String(), kademlia.NewRandomKademliaID().String()}
+	SendMessage(conn, "mget"+SEPARATING_STRING+strings.Join(keys, KEYS_SEPARATOR))
+	response := ListenToResponse(conn)
+
+	var replies []GetReply
+	if err := json.Unmarshal([]byte(response), &replies); err != nil {
+		t.Fatalf("Expected a JSON reply, got %q: %v", response, err)
+	}
+	if len(replies) != len(keys) {
+		t.Fatalf("Expected %d replies, got %d", len(keys), len(replies))
+	}
+	for i, reply := range replies {
+		if reply.Key != keys[i] || reply.Error != kademlia.ErrValueNotFound.Error() {
+			t.Errorf("Expected a not found error for %s, got %+v", keys[i], reply)
+		}
+	}
+
+	for _, request := range []string{"mget", "mget" + SEPARATING_STRING, "mget" + SEPARATING_STRING + keys[0] + KEYS_SEPARATOR + "zz"} {
+		fmt.Fprintln(conn, request)
+		response = ListenToResponse(conn)
+		if err := json.Unmarshal([]byte(response), &replies); err != nil || len(replies) != 1 || replies[0].Error == "" {
+			t.Errorf("Expected an error for %q, got %q", request, response)
+		}
+	}
+
+	SendMessage(conn, "exit")
+	<-done
+}
+
+func TestEncryptedBootstrap(t *testing.T) {
+	config := kademlia.DefaultConfig()
+	config.Encrypt = true
+	bootstrapSocket, socketPath := t.TempDir()+"/bootstrap.sock", t.TempDir()+"/node.sock"
+	bootstrap := NewServerWithPort(bootstrapSocket, "", 8107, config)
+	server := NewServerWithPort(socketPath, "127.0.0.1:8107", 8108, config)
+
+	bootstrapDone, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		bootstrap.Listen()
+		close(bootstrapDone)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		server.Listen()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The request is answered once the node has joined through the bootstrap node
+	conn := ConnectToServer(socketPath)
+	SendMessage(conn, "routes")
+	response := ListenToResponse(conn)
+
+	var snapshot kademlia.RoutingTableSnapshot
+	if err := json.Unmarshal([]byte(response), &snapshot); err != nil {
+		t.Fatalf("Expected a JSON routing table, got %q: %v", response, err)
+	}
+	found := false
+	for _, bucket := range snapshot.Buckets {
+		for _, contact := range bucket.Contacts {
+			found = found || contact.ID == bootstrap.node.Self.ID.String()
+		}
+	}
+	if !found {
+		t.Errorf("Expected the encrypted node to join through the bootstrap node, got %+v", snapshot)
+	}
+
+	SendMessage(conn, "exit")
+	<-done
+	bootstrapConn := ConnectToServer(bootstrapSocket)
+	SendMessage(bootstrapConn, "exit")
+	<-bootstrapDone
+}
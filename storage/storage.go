@@ -12,15 +12,26 @@ const ERR_INVALIDTIMESTAMP string = "INVALID TIMESTAMP"
 type StoredInfo struct {
 	information string
 	timestamp   int64
+	pinned      bool          // Pinned values never expire
+	cached      bool          // Cached copies expire ttl after they were stored, even if requested
+	ttl         time.Duration // TTL of the value, the TTL of the storage if zero
 }
 
 type Storage struct {
 	mutex   sync.Mutex
 	hashmap map[string]*StoredInfo
+	ttl     time.Duration
 }
 
+const DEFAULT_TTL time.Duration = 24 * time.Hour
+
 func NewStorage() *Storage {
-	return &Storage{hashmap: make(map[string]*StoredInfo)}
+	return NewStorageWithTTL(DEFAULT_TTL)
+}
+
+// Creates a storage where values are kept for ttl after they were last requested
+func NewStorageWithTTL(ttl time.Duration) *Storage {
+	return &Storage{hashmap: make(map[string]*StoredInfo), ttl: ttl}
 }
 
 func (storage *Storage) Get(key string) (string, bool) {
@@ -32,7 +43,9 @@ func (storage *Storage) Get(key string) (string, bool) {
 	value := storage.hashmap[key]
 	info := ""
 	if value != nil {
-		value.timestamp = time.Now().UnixMilli()
+		if !value.cached {
+			value.timestamp = time.Now().UnixMilli()
+		}
 		info = value.information
 	}
 	return info, value != nil
@@ -49,12 +62,47 @@ func (storage *Storage) PutWithTimestamp(key string, value string, timestamp int
 	if value == "" {
 		panic(ERR_INVALIDVALUE)
 	}
-	if !isTimestampValid(timestamp) {
+	if !storage.isTimestampValid(timestamp) {
 		panic(ERR_INVALIDTIMESTAMP)
 	}
 	storage.mutex.Lock()
 	defer storage.mutex.Unlock()
-	storage.hashmap[key] = &StoredInfo{information: value, timestamp: timestamp}
+	pinned := storage.hashmap[key] != nil && storage.hashmap[key].pinned
+	storage.hashmap[key] = &StoredInfo{information: value, timestamp: timestamp, pinned: pinned}
+}
+
+// Stores a cached copy of a value that expires after ttl, whether it is requested or not.
+// A value already stored as a primary copy is left as it is
+func (storage *Storage) PutCached(key string, value string, ttl time.Duration) {
+	if key == "" {
+		panic(ERR_INVALIDKEY)
+	}
+	if value == "" {
+		panic(ERR_INVALIDVALUE)
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if existing := storage.hashmap[key]; existing != nil && !existing.cached {
+		return
+	}
+	storage.hashmap[key] = &StoredInfo{information: value, timestamp: time.Now().UnixMilli(), cached: true, ttl: ttl}
+}
+
+// Returns true if the value stored under the key is only a cached copy, which
+// must not be republished as if this node were one of its k closest nodes
+func (storage *Storage) IsCached(key string) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	value := storage.hashmap[key]
+	return value != nil && value.cached
+}
+
+// Stores a value that is never removed by Clean, such as the values put by this node
+func (storage *Storage) PutPinned(key string, value string) {
+	storage.Put(key, value)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.hashmap[key].pinned = true
 }
 
 func (storage *Storage) Size() int {
@@ -65,12 +113,20 @@ func (storage *Storage) Clean() {
 	storage.mutex.Lock()
 	defer storage.mutex.Unlock()
 	for k, v := range storage.hashmap {
-		if !isTimestampValid(v.timestamp) {
+		if !v.pinned && storage.expired(v) {
 			delete(storage.hashmap, k)
 		}
 	}
 }
 
-func isTimestampValid(timestamp int64) bool {
-	return time.Now().UnixMilli()-timestamp <= 86400000
+func (storage *Storage) expired(info *StoredInfo) bool {
+	ttl := storage.ttl
+	if info.ttl > 0 {
+		ttl = info.ttl
+	}
+	return time.Now().UnixMilli()-info.timestamp > ttl.Milliseconds()
+}
+
+func (storage *Storage) isTimestampValid(timestamp int64) bool {
+	return time.Now().UnixMilli()-timestamp <= storage.ttl.Milliseconds()
 }
@@ -161,3 +161,71 @@ func TestResetTimestampBeforeCleaning(t *testing.T) {
 		t.Error("Error in reseting timestamp of ancient content")
 	}
 }
+
+// Test of cleaning values with a custom TTL
+func TestCleaningWithTTL(t *testing.T) {
+	storage := NewStorageWithTTL(100 * time.Millisecond)
+	storage.Put("key", "value")
+	storage.Clean()
+	if storage.Size() != 1 {
+		t.Error("Value should not be cleaned before its TTL expires")
+	}
+	time.Sleep(150 * time.Millisecond)
+	storage.Clean()
+	if storage.Size() != 0 {
+		t.Error("Value should be cleaned once its TTL expired")
+	}
+}
+
+// Test that pinned values are never cleaned, even when stored again
+func TestCleaningPinned(t *testing.T) {
+	storage := NewStorageWithTTL(10 * time.Millisecond)
+	storage.PutPinned("pinned", "value")
+	storage.Put("pinned", "value")
+	storage.Put("other", "value")
+	time.Sleep(20 * time.Millisecond)
+	storage.Clean()
+	if storage.Size() != 1 {
+		t.Error("Only the pinned value should be left after cleaning")
+	}
+	if _, exists := storage.Get("pinned"); !exists {
+		t.Error("Pinned value should not be cleaned")
+	}
+}
+
+// Test that cached copies expire after their own TTL even when requested
+func TestCachedExpiry(t *testing.T) {
+	storage := NewStorageWithTTL(time.Hour)
+	storage.PutCached("cached", "value", 50*time.Millisecond)
+	if !storage.IsCached("cached") {
+		t.Error("Value should be marked as cached")
+	}
+	time.Sleep(30 * time.Millisecond)
+	storage.Get("cached")
+	time.Sleep(30 * time.Millisecond)
+	storage.Clean()
+	if _, exists := storage.Get("cached"); exists {
+		t.Error("Requesting a cached copy should not extend its TTL")
+	}
+}
+
+// Test that a primary copy is never downgraded to a cached one, and replaces a cached one
+func TestCachedAndPrimary(t *testing.T) {
+	storage := NewStorageWithTTL(time.Hour)
+	storage.Put("primary", "value")
+	storage.PutCached("primary", "value", time.Millisecond)
+	if storage.IsCached("primary") {
+		t.Error("A primary copy should stay primary")
+	}
+
+	storage.PutCached("cached", "value", time.Millisecond)
+	storage.Put("cached", "value")
+	if storage.IsCached("cached") {
+		t.Error("Storing a value should turn its cached copy into a primary one")
+	}
+	time.Sleep(10 * time.Millisecond)
+	storage.Clean()
+	if storage.Size() != 2 {
+		t.Error("Primary copies should keep the TTL of the storage")
+	}
+}